@@ -111,11 +111,22 @@ func init() {
 }
 
 func newACBuild() (*lib.ACBuild, error) {
+	modifying := aciToModify != "" || ociToModify != ""
+	if scriptBuild != nil && !modifying {
+		return scriptBuild, nil
+	}
 	bmode, err := lib.GetBuildMode(contextpath)
 	if err != nil {
 		return nil, err
 	}
-	return lib.NewACBuild(contextpath, debug, bmode)
+	a, err := lib.NewACBuild(contextpath, debug, bmode)
+	if err != nil {
+		return nil, err
+	}
+	if scriptDepth > 0 && !modifying {
+		scriptBuild = a
+	}
+	return a, nil
 }
 
 func newACBuildWithBuildMode(bmode lib.BuildMode) (*lib.ACBuild, error) {
@@ -126,6 +137,12 @@ func getErrorCode(err error) int {
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
 	}
+	if status, ok := err.(exitStatus); ok {
+		return int(status)
+	}
+	if se, ok := err.(*scriptError); ok {
+		return getErrorCode(se.err)
+	}
 	switch err {
 	case appc.ErrNotFound:
 		return 2
@@ -146,7 +163,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 		if aciToModify == "" && ociToModify == "" {
 			cmdExitCode = cf(cmd, args)
 			switch cmd.Name() {
-			case "cat-manifest", "begin", "write", "end", "version", "gen-man-pages", "script":
+			case "cat-manifest", "begin", "write", "end", "version", "gen-man-pages", "script", "tree", "list", "build":
 				return
 			}
 			if cmdExitCode == 0 && !disableHistory {
@@ -167,7 +184,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 		}
 
 		switch cmd.Name() {
-		case "begin", "write", "end", "version", "gen-man-pages", "script":
+		case "begin", "write", "end", "version", "gen-man-pages", "script", "build":
 			stderr("Can't use --modify flags with %s.", cmd.Name())
 			cmdExitCode = 1
 			return
@@ -18,6 +18,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/containers/build/lib"
+	"github.com/containers/build/registry"
 )
 
 var (
@@ -33,6 +34,8 @@ var (
 func init() {
 	cmdAcbuild.AddCommand(cmdBegin)
 	cmdBegin.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over an unencrypted connection")
+	cmdBegin.Flags().IntVar(&fetchRetries, "fetch-retries", registry.DefaultRetries, "How many times to retry a failed download of the starting image")
+	cmdBegin.Flags().DurationVar(&fetchTimeout, "fetch-timeout", registry.DefaultTimeout, "How long to wait on a stalled download of the starting image")
 	cmdBegin.Flags().StringVar(&mode, "build-mode", "appc", "Which build mode to operate in. Accepts: appc, oci")
 }
 
@@ -61,6 +64,7 @@ func runBegin(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
+	setFetchOptions(a)
 	if len(args) == 0 {
 		err = a.Begin("", insecure, bmode)
 	} else {
@@ -0,0 +1,249 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/containers/build/buildspec"
+	"github.com/containers/build/lib"
+)
+
+var (
+	buildEngine    string
+	buildOverwrite bool
+	buildCheck     bool
+	cmdBuild       = &cobra.Command{
+		Use:     "build SPEC",
+		Short:   "Build an image from a YAML or JSON build specification",
+		Example: "acbuild build app.yaml",
+		Run:     runWrapper(runBuild),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdBuild)
+
+	cmdBuild.Flags().StringVar(&buildEngine, "engine", "systemd-nspawn", "The engine used to run the spec's run steps, as accepted by the run subcommand")
+	cmdBuild.Flags().BoolVar(&buildOverwrite, "overwrite", false, "Overwrite the spec's outputs if they already exist")
+	cmdBuild.Flags().BoolVar(&buildCheck, "check", false, "Check the spec for mistakes without building it")
+}
+
+func runBuild(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 1 {
+		cmd.Usage()
+		return 1
+	}
+
+	specPath := args[0]
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		stderr("build: %v", err)
+		return 1
+	}
+	s, err := buildspec.Parse(data)
+	if err != nil {
+		stderr("build: %s: %v", specPath, err)
+		return 1
+	}
+	problems := s.Validate()
+	if _, ok := engines[buildEngine]; !ok {
+		problems = append(problems, fmt.Sprintf("no such engine %q", buildEngine))
+	}
+	if len(problems) != 0 {
+		stderr("build: can't build %s:\n\t%s", specPath, strings.Join(problems, "\n\t"))
+		return 1
+	}
+	if buildCheck {
+		return 0
+	}
+
+	if debug {
+		stderr("Building %s", specPath)
+	}
+
+	err = buildSpec(s, filepath.Dir(specPath))
+	if err != nil {
+		stderr("build: %v", err)
+		return getErrorCode(err)
+	}
+	return 0
+}
+
+// buildSpec builds the image described by s in a temporary build context.
+// Relative paths in s are relative to dir.
+func buildSpec(s *buildspec.Spec, dir string) (err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	relPath := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "acbuild")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mode := lib.BuildMode(s.Mode)
+	a, err := lib.NewACBuild(tmpDir, debug, mode)
+	if err != nil {
+		return err
+	}
+	setFetchOptions(a)
+
+	base := s.Base
+	if strings.HasPrefix(base, ".") {
+		base = relPath(base)
+	}
+	err = a.Begin(base, s.Insecure, mode)
+	if err != nil {
+		return fmt.Errorf("begin: %v", err)
+	}
+	defer func() {
+		if err1 := a.End(); err == nil {
+			err = err1
+		}
+	}()
+
+	err = applySpecManifest(a, s)
+	if err != nil {
+		return err
+	}
+
+	for i, step := range s.Steps {
+		switch {
+		case step.Run != nil:
+			err = a.Run(step.Run, step.WorkingDirectory, s.Insecure, engines[buildEngine])
+		case step.Copy != nil:
+			opts := lib.CopyOptions{Insecure: s.Insecure, Exclude: step.Copy.Exclude, Context: dir}
+			err = a.CopyToTarget(relPath(step.Copy.From), step.Copy.To, opts)
+		case step.CopyToDir != nil:
+			var froms []string
+			for _, from := range step.CopyToDir.From {
+				froms = append(froms, relPath(from))
+			}
+			opts := lib.CopyOptions{Insecure: s.Insecure, Exclude: step.CopyToDir.Exclude, Context: dir}
+			err = a.CopyToDir(froms, step.CopyToDir.To, opts)
+		}
+		if err != nil {
+			return fmt.Errorf("steps[%d]: %v", i, err)
+		}
+	}
+
+	for _, output := range s.Outputs {
+		if debug {
+			stderr("Writing %s", output)
+		}
+		_, err = a.Write(relPath(output), buildOverwrite)
+		if err != nil {
+			return fmt.Errorf("writing %s: %v", output, err)
+		}
+	}
+	return nil
+}
+
+// applySpecManifest sets the image's metadata from s.
+func applySpecManifest(a *lib.ACBuild, s *buildspec.Spec) error {
+	if s.Name != "" {
+		if err := a.SetName(s.Name); err != nil {
+			return fmt.Errorf("name: %v", err)
+		}
+	}
+
+	maps := []struct {
+		field string
+		m     map[string]string
+		add   func(name, value string) error
+	}{
+		{"labels", s.Labels, a.AddLabel},
+		{"annotations", s.Annotations, a.AddAnnotation},
+		{"environment", s.Environment, a.AddEnv},
+	}
+	for _, f := range maps {
+		var names []string
+		for name := range f.m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := f.add(name, f.m[name]); err != nil {
+				return fmt.Errorf("%s: %s: %v", f.field, name, err)
+			}
+		}
+	}
+
+	for _, p := range s.Ports {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		count := p.Count
+		if count == 0 {
+			count = 1
+		}
+		if err := a.AddPort(p.Name, protocol, p.Port, count, p.SocketActivated); err != nil {
+			return fmt.Errorf("ports: %s: %v", p.Name, err)
+		}
+	}
+	for _, m := range s.Mounts {
+		if err := a.AddMount(m.Name, m.Path, m.ReadOnly); err != nil {
+			return fmt.Errorf("mounts: %s: %v", m.Name, err)
+		}
+	}
+	for _, iso := range s.Isolators {
+		val, err := iso.ValueJSON()
+		if err == nil {
+			err = a.AddIsolator(iso.Name, val)
+		}
+		if err != nil {
+			return fmt.Errorf("isolators: %s: %v", iso.Name, err)
+		}
+	}
+
+	if s.User != "" {
+		if err := a.SetUser(s.User); err != nil {
+			return fmt.Errorf("user: %v", err)
+		}
+	}
+	if s.Group != "" {
+		if err := a.SetGroup(s.Group); err != nil {
+			return fmt.Errorf("group: %v", err)
+		}
+	}
+	if s.WorkingDirectory != "" {
+		if err := a.SetWorkingDir(s.WorkingDirectory); err != nil {
+			return fmt.Errorf("workingDirectory: %v", err)
+		}
+	}
+	if len(s.Exec) != 0 {
+		if err := a.SetExec(s.Exec); err != nil {
+			return fmt.Errorf("exec: %v", err)
+		}
+	}
+	return nil
+}
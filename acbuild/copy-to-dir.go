@@ -25,13 +25,15 @@ var (
 	cmdCopyToDir = &cobra.Command{
 		Use:     "copy-to-dir PATH1_ON_HOST PATH2_ON_HOST ... PATH_IN_ACI",
 		Short:   "Copy a file or directory into a directory in the image",
-		Example: "acbuild copy-to-dir build/bin/* /usr/bin",
+		Example: "acbuild copy-to-dir build/bin/* /usr/bin\n  acbuild copy-to-dir --chown app --chmod 0755 build/bin/* /usr/bin",
 		Run:     runWrapper(runCopyToDir),
 	}
 )
 
 func init() {
 	cmdAcbuild.AddCommand(cmdCopyToDir)
+
+	addCopyOptionFlags(cmdCopyToDir)
 }
 
 func runCopyToDir(cmd *cobra.Command, args []string) (exit int) {
@@ -43,6 +45,11 @@ func runCopyToDir(cmd *cobra.Command, args []string) (exit int) {
 		stderr("copy-to-dir: incorrect number of arguments")
 		return 1
 	}
+	opts, err := copyOptions()
+	if err != nil {
+		stderr("copy-to-dir: %v", err)
+		return 1
+	}
 
 	if debug {
 		logMsg := "Copying "
@@ -59,7 +66,7 @@ func runCopyToDir(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
-	err = a.CopyToDir(args[:len(args)-1], args[len(args)-1])
+	err = a.CopyToDir(args[:len(args)-1], args[len(args)-1], opts)
 
 	if err != nil {
 		stderr("copy-to-dir: %v", err)
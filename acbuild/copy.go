@@ -15,20 +15,85 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
 	"github.com/spf13/cobra"
+
+	"github.com/containers/build/lib"
+	"github.com/containers/build/registry"
 )
 
 var (
-	cmdCopy = &cobra.Command{
-		Use:     "copy PATH_ON_HOST PATH_IN_ACI",
+	copyFrom    string
+	copyChown   string
+	copyChmod   string
+	copyExclude patternList
+	copyExtract bool
+	copySHA256  string
+	cmdCopy     = &cobra.Command{
+		Use:     "copy PATH_ON_HOST|URL PATH_IN_ACI",
 		Short:   "Copy a file or directory into the image",
-		Example: "acbuild copy nginx.conf /etc/nginx/nginx.conf",
+		Example: "acbuild copy nginx.conf /etc/nginx/nginx.conf\n  acbuild copy --from builder /go/bin/app /usr/bin/app\n  acbuild copy --chown nginx:nginx --chmod 0640 nginx.conf /etc/nginx/nginx.conf\n  acbuild copy --extract --sha256 SUM https://example.com/app.tar.gz /opt/app",
 		Run:     runWrapper(runCopy),
 	}
 )
 
 func init() {
 	cmdAcbuild.AddCommand(cmdCopy)
+
+	cmdCopy.Flags().StringVar(&copyFrom, "from", "", "Copy from a stage of the running script, another build's work path, or an image, instead of the host")
+	cmdCopy.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching the image given to --from, or a URL, over http, and skips TLS verification")
+	cmdCopy.Flags().BoolVar(&copyExtract, "extract", false, "Unpack the tar or zip archive downloaded from a URL into the target directory")
+	cmdCopy.Flags().StringVar(&copySHA256, "sha256", "", "Expected SHA-256 checksum, in hex, of the file downloaded from a URL")
+	cmdCopy.Flags().IntVar(&fetchRetries, "fetch-retries", registry.DefaultRetries, "How many times to retry a failed download of a URL")
+	cmdCopy.Flags().DurationVar(&fetchTimeout, "fetch-timeout", registry.DefaultTimeout, "How long to wait on a stalled download of a URL")
+	addCopyOptionFlags(cmdCopy)
+}
+
+// addCopyOptionFlags adds the flags that change how files are copied into
+// the image to cmd.
+func addCopyOptionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&copyChown, "chown", "", "Owner of the copied files, as USER[:GROUP] names in the image or numeric IDs")
+	cmd.Flags().StringVar(&copyChmod, "chmod", "", "Mode of the copied files and directories, in octal")
+	cmd.Flags().Var(&copyExclude, "exclude", "Pattern, in .acbuildignore syntax, for files to leave out of the copy")
+}
+
+// patternList holds the patterns given to a flag that can be repeated.
+type patternList []string
+
+func (pl *patternList) String() string {
+	return strings.Join(*pl, " ")
+}
+
+func (pl *patternList) Set(input string) error {
+	*pl = append(*pl, input)
+	return nil
+}
+
+func (pl *patternList) reset() {
+	*pl = nil
+}
+
+func (pl *patternList) Type() string {
+	return "Patterns"
+}
+
+// copyOptions returns the options set by the flags added by
+// addCopyOptionFlags.
+func copyOptions() (lib.CopyOptions, error) {
+	opts := lib.CopyOptions{Chown: copyChown, Insecure: insecure, Exclude: copyExclude}
+	if copyChmod != "" {
+		mode, err := strconv.ParseUint(copyChmod, 8, 32)
+		if err != nil || mode == 0 || mode&^uint64(os.ModePerm) != 0 {
+			return opts, fmt.Errorf("invalid mode %q", copyChmod)
+		}
+		opts.Chmod = os.FileMode(mode)
+	}
+	return opts, nil
 }
 
 func runCopy(cmd *cobra.Command, args []string) (exit int) {
@@ -40,9 +105,31 @@ func runCopy(cmd *cobra.Command, args []string) (exit int) {
 		stderr("copy: incorrect number of arguments")
 		return 1
 	}
+	opts, err := copyOptions()
+	if err != nil {
+		stderr("copy: %v", err)
+		return 1
+	}
+	if copyFrom != "" && len(copyExclude) != 0 {
+		stderr("copy: --exclude can't be used with --from")
+		return 1
+	}
+	isURL := lib.IsURL(args[0])
+	switch {
+	case isURL && copyFrom != "":
+		stderr("copy: --from can't be used with a URL")
+		return 1
+	case !isURL && (copyExtract || copySHA256 != ""):
+		stderr("copy: --extract and --sha256 can only be used with a URL")
+		return 1
+	}
 
 	if debug {
-		stderr("Copying host:%s to aci:%s", args[0], args[1])
+		if copyFrom != "" {
+			stderr("Copying %s:%s to aci:%s", copyFrom, args[0], args[1])
+		} else {
+			stderr("Copying host:%s to aci:%s", args[0], args[1])
+		}
 	}
 
 	a, err := newACBuild()
@@ -50,7 +137,16 @@ func runCopy(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
-	err = a.CopyToTarget(args[0], args[1])
+	switch {
+	case isURL:
+		setFetchOptions(a)
+		err = a.CopyFromURL(args[0], args[1], copyExtract, copySHA256, opts)
+	case copyFrom != "":
+		setFetchOptions(a)
+		err = copyFromSource(a, copyFrom, args[0], args[1], opts)
+	default:
+		err = a.CopyToTarget(args[0], args[1], opts)
+	}
 
 	if err != nil {
 		stderr("copy: %v", err)
@@ -59,3 +155,42 @@ func runCopy(cmd *cobra.Command, args []string) (exit int) {
 
 	return 0
 }
+
+// copyFromSource copies from into a from the named stage of the running
+// script, the build in the work path source, or the image source.
+func copyFromSource(a *lib.ACBuild, source, from, to string, opts lib.CopyOptions) error {
+	workPath, ok := scriptStageWorkPath(source)
+	if !ok {
+		if _, err := os.Stat(filepath.Join(source, ".acbuild")); err == nil {
+			workPath = source
+		}
+	}
+	if workPath == "" {
+		return a.CopyFromImage(source, from, to, insecure, opts)
+	}
+
+	srcPath, err := filepath.Abs(workPath)
+	if err != nil {
+		return err
+	}
+	dstPath, err := filepath.Abs(filepath.Dir(a.ContextPath))
+	if err != nil {
+		return err
+	}
+	if srcPath == dstPath {
+		return fmt.Errorf("can't copy from the build being copied into")
+	}
+	mode, err := lib.GetBuildMode(workPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no build in progress in %s", source)
+	}
+	if err != nil {
+		return err
+	}
+	src, err := lib.NewACBuild(workPath, debug, mode)
+	if err != nil {
+		return err
+	}
+	setFetchOptions(src)
+	return a.CopyFromBuild(src, from, to, insecure, opts)
+}
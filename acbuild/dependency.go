@@ -15,12 +15,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/appc/spec/discovery"
 	"github.com/appc/spec/schema/types"
+	"github.com/coreos/ioprogress"
 	"github.com/spf13/cobra"
+
+	"github.com/containers/build/lib"
 )
 
 var (
@@ -29,31 +35,69 @@ var (
 	size    uint
 	cmdDep  = &cobra.Command{
 		Use:   "dependency [command]",
-		Short: "Manage dependencies (appc only)",
+		Short: "Manage dependencies, or base images in OCI builds",
 	}
 	cmdAddDep = &cobra.Command{
 		Use:     "add IMAGE_NAME",
-		Short:   "Add a new dependency, or update an existing one (appc only)",
+		Short:   "Add a new dependency, or update an existing one",
 		Example: "acbuild dependency add example.com/reduce-worker-base --label os=linux --label env=canary --size 22017258",
 		Run:     runWrapper(runAddDep),
 	}
 	cmdRmDep = &cobra.Command{
 		Use:     "remove IMAGE_NAME",
 		Aliases: []string{"rm"},
-		Short:   "Remove a dependency (appc only)",
+		Short:   "Remove a dependency",
 		Example: "acbuild dependency remove example.com/reduce-worker-base",
 		Run:     runWrapper(runRmDep),
 	}
+
+	lockSavePath    string
+	lockFromPath    string
+	lockPinManifest bool
+	cmdLockDep      = &cobra.Command{
+		Use:     "lock",
+		Short:   "Pin the dependencies to the exact images they resolve to (appc only)",
+		Example: "acbuild dependency lock --save acbuild.lock",
+		Run:     runWrapper(runLockDep),
+	}
+
+	depJSON     bool
+	cmdTreeDeps = &cobra.Command{
+		Use:     "tree",
+		Short:   "Print the resolved dependency graph (appc only)",
+		Example: "acbuild dependency tree --json",
+		Run:     runWrapper(runTreeDeps),
+	}
+	cmdListDeps = &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List the images that will be layered under the rootfs, from the bottom up (appc only)",
+		Example: "acbuild dependency list",
+		Run:     runWrapper(runListDeps),
+	}
 )
 
 func init() {
 	cmdAcbuild.AddCommand(cmdDep)
 	cmdDep.AddCommand(cmdAddDep)
 	cmdDep.AddCommand(cmdRmDep)
+	cmdDep.AddCommand(cmdLockDep)
+	cmdDep.AddCommand(cmdTreeDeps)
+	cmdDep.AddCommand(cmdListDeps)
 
 	cmdAddDep.Flags().StringVar(&imageId, "image-id", "", "Content hash of the dependency")
 	cmdAddDep.Flags().Var(&labels, "label", "Labels used for dependency matching")
 	cmdAddDep.Flags().UintVar(&size, "size", 0, "The size of the image of the referenced dependency, in bytes")
+
+	cmdLockDep.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http")
+	cmdLockDep.Flags().StringVar(&lockSavePath, "save", "", "Also write the lock to the given file")
+	cmdLockDep.Flags().StringVar(&lockFromPath, "from", "", "Use the lock in the given file instead of resolving the dependencies")
+	cmdLockDep.Flags().BoolVar(&lockPinManifest, "pin-manifest", false, "Write the image IDs and sizes of the dependencies into the manifest")
+
+	for _, c := range []*cobra.Command{cmdTreeDeps, cmdListDeps} {
+		c.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http")
+		c.Flags().BoolVar(&depJSON, "json", false, "Print the dependencies as JSON")
+	}
 }
 
 func runAddDep(cmd *cobra.Command, args []string) (exit int) {
@@ -70,6 +114,25 @@ func runAddDep(cmd *cobra.Command, args []string) (exit int) {
 		stderr("Adding dependency %q", args[0])
 	}
 
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+
+	if a.Mode == lib.BuildModeOCI {
+		if imageId != "" || len(labels) != 0 || size != 0 {
+			stderr("dependency add: --image-id, --label and --size are only supported in appc builds")
+			return 1
+		}
+		err = a.AddBaseImage(args[0])
+		if err != nil {
+			stderr("dependency add: %v", err)
+			return getErrorCode(err)
+		}
+		return 0
+	}
+
 	app, err := discovery.NewAppFromString(args[0])
 	if err != nil {
 		stderr("dependency add: couldn't parse dependency name: %v", err)
@@ -99,11 +162,6 @@ func runAddDep(cmd *cobra.Command, args []string) (exit int) {
 		}
 	}
 
-	a, err := newACBuild()
-	if err != nil {
-		stderr("%v", err)
-		return 1
-	}
 	err = a.AddDependency(app.Name, hash, appcLabels, size)
 
 	if err != nil {
@@ -133,7 +191,11 @@ func runRmDep(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
-	err = a.RemoveDependency(args[0])
+	if a.Mode == lib.BuildModeOCI {
+		err = a.RemoveBaseImage(args[0])
+	} else {
+		err = a.RemoveDependency(args[0])
+	}
 
 	if err != nil {
 		stderr("dependency remove: %v", err)
@@ -143,6 +205,190 @@ func runRmDep(cmd *cobra.Command, args []string) (exit int) {
 	return 0
 }
 
+func runLockDep(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		cmd.Usage()
+		return 1
+	}
+	if lockFromPath != "" && (lockSavePath != "" || lockPinManifest) {
+		stderr("dependency lock: --from can't be used with --save or --pin-manifest")
+		return 1
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+
+	if lockFromPath != "" {
+		if debug {
+			stderr("Using dependency lock %s", lockFromPath)
+		}
+		err = a.UseDependencyLock(lockFromPath)
+		if err != nil {
+			stderr("dependency lock: %v", err)
+			return getErrorCode(err)
+		}
+		return 0
+	}
+
+	if debug {
+		stderr("Locking dependencies")
+	}
+
+	setFetchOptions(a)
+	lock, err := a.LockDependencies(insecure, lockPinManifest)
+	if err != nil {
+		stderr("dependency lock: %v", err)
+		return getErrorCode(err)
+	}
+
+	if lockSavePath != "" {
+		err = lib.WriteDependencyLock(lock, lockSavePath)
+		if err != nil {
+			stderr("dependency lock: %v", err)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func runTreeDeps(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		cmd.Usage()
+		return 1
+	}
+
+	if debug {
+		stderr("Resolving dependency tree")
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	setFetchOptions(a)
+	tree, err := a.DependencyTree(insecure)
+	if err != nil {
+		stderr("dependency tree: %v", err)
+		return getErrorCode(err)
+	}
+
+	if depJSON {
+		err = printJSON(tree)
+		if err != nil {
+			stderr("dependency tree: %v", err)
+			return 1
+		}
+	} else {
+		printDepNodes(tree.Dependencies, "")
+	}
+
+	for _, p := range tree.Problems {
+		stderr("dependency tree: %s", p)
+	}
+	if len(tree.Problems) != 0 {
+		return 1
+	}
+	return 0
+}
+
+func printDepNodes(nodes []*lib.DependencyNode, indent string) {
+	for _, n := range nodes {
+		line := indent + depString(n.ImageName, n.Labels)
+		if n.ImageID != "" {
+			line += fmt.Sprintf("  %s  %s", shortImageID(n.ImageID), sizeString(n.Size))
+		} else {
+			line += "  (unresolved)"
+		}
+		if n.Cycle {
+			line += "  (cycle)"
+		}
+		stdout("%s", line)
+		if len(n.PathWhitelist) != 0 {
+			stdout("%s    path whitelist: %s", indent, strings.Join(n.PathWhitelist, ", "))
+		}
+		printDepNodes(n.Dependencies, indent+"    ")
+	}
+}
+
+func runListDeps(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		cmd.Usage()
+		return 1
+	}
+
+	if debug {
+		stderr("Resolving dependency list")
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	setFetchOptions(a)
+	images, err := a.DependencyList(insecure)
+	if err != nil {
+		stderr("dependency list: %v", err)
+		return getErrorCode(err)
+	}
+
+	if depJSON {
+		err = printJSON(images)
+		if err != nil {
+			stderr("dependency list: %v", err)
+			return 1
+		}
+		return 0
+	}
+
+	tabOut := new(tabwriter.Writer)
+	tabOut.Init(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tabOut, "IMAGE\tIMAGE ID\tSIZE\tFILES\tPATH WHITELIST")
+	for _, img := range images {
+		fmt.Fprintf(tabOut, "%s\t%s\t%s\t%d\t%s\n", depString(img.ImageName, img.Labels),
+			shortImageID(img.ImageID), sizeString(img.Size), img.Files, strings.Join(img.PathWhitelist, ","))
+	}
+	tabOut.Flush()
+	return 0
+}
+
+func printJSON(v interface{}) error {
+	blob, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	stdout("%s", blob)
+	return nil
+}
+
+func depString(name types.ACIdentifier, labels types.Labels) string {
+	s := string(name)
+	for _, l := range labels {
+		s += "," + string(l.Name) + "=" + l.Value
+	}
+	return s
+}
+
+func shortImageID(id string) string {
+	const shortLen = len("sha512-") + 12
+	if len(id) > shortLen {
+		return id[:shortLen]
+	}
+	return id
+}
+
+func sizeString(size uint) string {
+	if size == 0 {
+		return "-"
+	}
+	return ioprogress.ByteUnitStr(int64(size))
+}
+
 type labellist []types.Label
 
 func (ls *labellist) String() string {
@@ -169,6 +415,10 @@ func (ls *labellist) Set(input string) error {
 	return nil
 }
 
+func (ls *labellist) reset() {
+	*ls = nil
+}
+
 func (ls *labellist) Type() string {
 	return "Labels"
 }
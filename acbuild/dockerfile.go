@@ -0,0 +1,669 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/containers/build/dockerfile"
+	"github.com/containers/build/lib"
+)
+
+var (
+	dockerfileMode      string
+	dockerfileArgs      buildArgs
+	dockerfileContext   string
+	dockerfileName      string
+	dockerfileEngine    string
+	dockerfileInsecure  bool
+	dockerfileOverwrite bool
+	cmdDockerfile       = &cobra.Command{
+		Use:   "dockerfile [command]",
+		Short: "Build images from Dockerfiles",
+	}
+	cmdDockerfileBuild = &cobra.Command{
+		Use:     "build DOCKERFILE OUTPUT",
+		Short:   "Build an image from a Dockerfile",
+		Example: "acbuild dockerfile build --build-mode appc --name example.com/app Dockerfile app.aci",
+		Run:     runWrapper(runDockerfileBuild),
+	}
+
+	// dockerfileSupported lists the instructions that can be translated to
+	// acbuild commands. Anything else is reported before the build starts.
+	dockerfileSupported = map[string]bool{
+		"FROM": true, "RUN": true, "COPY": true, "ADD": true, "ENV": true,
+		"WORKDIR": true, "USER": true, "EXPOSE": true, "VOLUME": true,
+		"LABEL": true, "CMD": true, "ENTRYPOINT": true, "ARG": true,
+		"SHELL": true, "MAINTAINER": true,
+	}
+
+	mountNameRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdDockerfile)
+	cmdDockerfile.AddCommand(cmdDockerfileBuild)
+
+	cmdDockerfileBuild.Flags().StringVar(&dockerfileMode, "build-mode", "oci", "Which build mode to operate in. Accepts: appc, oci")
+	cmdDockerfileBuild.Flags().Var(&dockerfileArgs, "arg", "Build argument of the form NAME=VALUE, for ARG instructions in the Dockerfile")
+	cmdDockerfileBuild.Flags().StringVar(&dockerfileContext, "context", "", "Directory COPY and ADD sources are relative to (default is the Dockerfile's directory)")
+	cmdDockerfileBuild.Flags().StringVar(&dockerfileName, "name", "", "Name of the resulting image, required in appc builds")
+	cmdDockerfileBuild.Flags().StringVar(&dockerfileEngine, "engine", "systemd-nspawn", "The engine used to run RUN instructions, as accepted by the run subcommand")
+	cmdDockerfileBuild.Flags().BoolVar(&dockerfileInsecure, "insecure", false, "Allows fetching the base image over an unencrypted connection")
+	cmdDockerfileBuild.Flags().BoolVar(&dockerfileOverwrite, "overwrite", false, "Overwrite the resulting image")
+}
+
+func runDockerfileBuild(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 2 {
+		cmd.Usage()
+		return 1
+	}
+
+	// The flags are reset by every acbuild command the Dockerfile is
+	// translated to, so they have to be copied out first.
+	b := &dockerfileBuild{
+		path:      args[0],
+		output:    args[1],
+		mode:      lib.BuildMode(dockerfileMode),
+		context:   dockerfileContext,
+		name:      dockerfileName,
+		engine:    dockerfileEngine,
+		insecure:  dockerfileInsecure,
+		overwrite: dockerfileOverwrite,
+		args:      make(map[string]string),
+	}
+	for name, val := range dockerfileArgs {
+		b.args[name] = val
+	}
+	if b.context == "" {
+		b.context = filepath.Dir(b.path)
+	}
+
+	if debug {
+		stderr("Building %s from %s", b.output, b.path)
+	}
+
+	err := b.build()
+	if err != nil {
+		stderr("dockerfile build: %v", err)
+		return getErrorCode(err)
+	}
+	return 0
+}
+
+// dockerfileBuild translates a Dockerfile to acbuild commands, and runs them
+// in this process the same way a script is.
+type dockerfileBuild struct {
+	path      string
+	output    string
+	mode      lib.BuildMode
+	context   string
+	name      string
+	engine    string
+	insecure  bool
+	overwrite bool
+
+	// args holds the build arguments given with --arg, and used the names of
+	// the ones an ARG instruction asked for.
+	args map[string]string
+	used map[string]struct{}
+
+	df       *dockerfile.Dockerfile
+	workPath string
+	emptyDir string
+	begun    bool
+
+	// metaArgs holds the arguments declared before FROM, which are only
+	// visible to FROM and to ARG instructions redeclaring them.
+	metaArgs map[string]string
+	buildArg map[string]string
+	argOrder []string
+	env      map[string]string
+	workdir  string
+	shell    []string
+
+	entrypoint []string
+	cmd        []string
+	exposed    map[string]struct{}
+	volumes    map[string]struct{}
+}
+
+func (b *dockerfileBuild) build() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	b.df, err = dockerfile.Parse(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", b.path, err)
+	}
+	b.context, err = filepath.Abs(b.context)
+	if err != nil {
+		return err
+	}
+	if err := b.check(); err != nil {
+		return err
+	}
+
+	b.used = make(map[string]struct{})
+	b.metaArgs = make(map[string]string)
+	b.buildArg = make(map[string]string)
+	b.env = make(map[string]string)
+	b.workdir = "/"
+	b.shell = []string{"/bin/sh", "-c"}
+	b.exposed = make(map[string]struct{})
+	b.volumes = make(map[string]struct{})
+
+	return inScriptBuild(func(workPath string) error {
+		b.workPath = workPath
+		b.emptyDir = filepath.Join(workPath, "empty")
+		err := os.Mkdir(b.emptyDir, 0755)
+		if err != nil {
+			return err
+		}
+		for _, inst := range b.df.Instructions {
+			err := b.exec(inst)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s: %v", b.path, inst.Line, inst.Command, err)
+			}
+		}
+		if exec := append(append([]string{}, b.entrypoint...), b.cmd...); len(exec) > 0 {
+			err := b.acbuild(append([]string{"set-exec", "--"}, exec...)...)
+			if err != nil {
+				return err
+			}
+		}
+		for name := range b.args {
+			if _, ok := b.used[name]; !ok {
+				stderr("dockerfile build: warning: build argument %s was never declared with ARG", name)
+			}
+		}
+		writeArgs := []string{"write"}
+		if b.overwrite {
+			writeArgs = append(writeArgs, "--overwrite")
+		}
+		return b.acbuild(append(writeArgs, b.output)...)
+	})
+}
+
+// check reports everything in the Dockerfile that can't be translated before
+// any of it is run.
+func (b *dockerfileBuild) check() error {
+	var problems []string
+	report := func(inst dockerfile.Instruction, format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s:%d: %s", b.path, inst.Line, fmt.Sprintf(format, a...)))
+	}
+
+	switch b.mode {
+	case lib.BuildModeAppC:
+		if b.name == "" {
+			problems = append(problems, "appc builds need an image name, set one with --name")
+		}
+	case lib.BuildModeOCI:
+		if b.name != "" {
+			problems = append(problems, "--name is only supported in appc builds")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown build mode %q", b.mode))
+	}
+
+	froms := 0
+	for _, inst := range b.df.Instructions {
+		if !dockerfileSupported[inst.Command] {
+			report(inst, "%s is not supported", inst.Command)
+			continue
+		}
+		switch inst.Command {
+		case "FROM":
+			froms++
+			if froms == 2 {
+				report(inst, "multi-stage builds are not supported")
+			}
+		case "ARG":
+		default:
+			if froms == 0 {
+				report(inst, "%s before FROM", inst.Command)
+			}
+		}
+		for flag := range inst.Flags {
+			report(inst, "%s --%s is not supported", inst.Command, flag)
+		}
+		if inst.Command == "RUN" && os.Geteuid() != 0 {
+			report(inst, "RUN needs acbuild to be run as root")
+		}
+		if inst.Command == "SHELL" && !inst.JSON {
+			report(inst, "SHELL must be given as a JSON array")
+		}
+	}
+	if froms == 0 {
+		problems = append(problems, fmt.Sprintf("%s: no FROM instruction", b.path))
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("can't build %s:\n\t%s", b.path, strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// acbuild runs the acbuild command given by args against the build.
+func (b *dockerfileBuild) acbuild(args ...string) error {
+	return execACBuild(b.workPath, args)
+}
+
+// lookup returns the value of a variable visible to instructions after FROM.
+// Environment variables take precedence over build arguments.
+func (b *dockerfileBuild) lookup(name string) (string, bool) {
+	if val, ok := b.env[name]; ok {
+		return val, true
+	}
+	val, ok := b.buildArg[name]
+	return val, ok
+}
+
+func (b *dockerfileBuild) metaLookup(name string) (string, bool) {
+	val, ok := b.metaArgs[name]
+	return val, ok
+}
+
+func (b *dockerfileBuild) words(inst dockerfile.Instruction) ([]string, error) {
+	if inst.JSON {
+		var words []string
+		for _, arg := range inst.JSONArgs {
+			w, err := dockerfile.Word(arg, b.df.Escape, b.lookup)
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, w)
+		}
+		return words, nil
+	}
+	return dockerfile.Words(inst.Args, b.df.Escape, b.lookup)
+}
+
+func (b *dockerfileBuild) exec(inst dockerfile.Instruction) error {
+	switch inst.Command {
+	case "ARG":
+		return b.execArg(inst)
+	case "FROM":
+		return b.execFrom(inst)
+	case "RUN":
+		return b.execRun(inst)
+	case "COPY", "ADD":
+		return b.execCopy(inst)
+	case "ENV":
+		kvs, err := dockerfile.KeyValues(inst.Args, b.df.Escape, b.lookup)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			if !kv.HasValue {
+				return fmt.Errorf("missing value for %s", kv.Key)
+			}
+			err := b.acbuild("environment", "add", kv.Key, kv.Value)
+			if err != nil {
+				return err
+			}
+			b.env[kv.Key] = kv.Value
+		}
+		return nil
+	case "LABEL":
+		kvs, err := dockerfile.KeyValues(inst.Args, b.df.Escape, b.lookup)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			err := b.acbuild("annotation", "add", kv.Key, kv.Value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "MAINTAINER":
+		maintainer, err := dockerfile.Word(inst.Args, b.df.Escape, b.lookup)
+		if err != nil {
+			return err
+		}
+		return b.acbuild("annotation", "add", "maintainer", maintainer)
+	case "WORKDIR":
+		dir, err := dockerfile.Word(inst.Args, b.df.Escape, b.lookup)
+		if err != nil {
+			return err
+		}
+		b.workdir = b.resolve(dir)
+		// Docker creates the working directory if it doesn't exist, which
+		// copying an empty directory to it does.
+		err = b.acbuild("copy", b.emptyDir, b.workdir)
+		if err != nil {
+			return err
+		}
+		return b.acbuild("set-working-directory", b.workdir)
+	case "USER":
+		user, err := dockerfile.Word(inst.Args, b.df.Escape, b.lookup)
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(user, ":", 2)
+		err = b.acbuild("set-user", parts[0])
+		if err == nil && len(parts) == 2 {
+			err = b.acbuild("set-group", parts[1])
+		}
+		return err
+	case "EXPOSE":
+		return b.execExpose(inst)
+	case "VOLUME":
+		words, err := b.words(inst)
+		if err != nil {
+			return err
+		}
+		for _, vol := range words {
+			vol = b.resolve(vol)
+			name := strings.Trim(mountNameRegexp.ReplaceAllString(strings.ToLower(vol), "-"), "-")
+			if name == "" {
+				name = "root"
+			}
+			if _, ok := b.volumes[name]; ok {
+				continue
+			}
+			b.volumes[name] = struct{}{}
+			err := b.acbuild("mount", "add", name, vol)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "CMD", "ENTRYPOINT":
+		exec, err := b.execForm(inst)
+		if err != nil {
+			return err
+		}
+		if inst.Command == "CMD" {
+			b.cmd = exec
+		} else {
+			b.entrypoint = exec
+		}
+		return nil
+	case "SHELL":
+		if len(inst.JSONArgs) == 0 {
+			return fmt.Errorf("no shell given")
+		}
+		b.shell = inst.JSONArgs
+		return nil
+	}
+	return fmt.Errorf("not supported")
+}
+
+func (b *dockerfileBuild) execArg(inst dockerfile.Instruction) error {
+	kvs, err := dockerfile.KeyValues(inst.Args, b.df.Escape, nil)
+	if err != nil {
+		return err
+	}
+	vars := b.metaArgs
+	if b.begun {
+		vars = b.buildArg
+	}
+	for _, kv := range kvs {
+		if !varNameRegexp.MatchString(kv.Key) {
+			return fmt.Errorf("invalid argument name %q", kv.Key)
+		}
+		val, ok := b.args[kv.Key]
+		switch {
+		case ok:
+			b.used[kv.Key] = struct{}{}
+		case kv.HasValue:
+			val, err = dockerfile.Word(kv.Value, b.df.Escape, b.lookup)
+			if err != nil {
+				return err
+			}
+		default:
+			val, ok = b.metaArgs[kv.Key]
+			if !ok {
+				continue
+			}
+		}
+		vars[kv.Key] = val
+		if b.begun {
+			b.argOrder = append(b.argOrder, kv.Key)
+		}
+	}
+	return nil
+}
+
+func (b *dockerfileBuild) execFrom(inst dockerfile.Instruction) error {
+	words, err := dockerfile.Words(inst.Args, b.df.Escape, b.metaLookup)
+	if err != nil {
+		return err
+	}
+	if len(words) != 1 && !(len(words) == 3 && strings.EqualFold(words[1], "as")) {
+		return fmt.Errorf("expected an image, optionally followed by AS NAME")
+	}
+	image := words[0]
+
+	begin := []string{"begin", "--build-mode=" + string(b.mode)}
+	if b.insecure {
+		begin = append(begin, "--insecure")
+	}
+	local := strings.HasPrefix(image, "/") || strings.HasPrefix(image, ".")
+	switch {
+	case image == "scratch":
+		err = b.acbuild(begin...)
+	case local || b.mode == lib.BuildModeAppC:
+		if !local {
+			image = "docker://" + image
+		}
+		err = b.acbuild(append(begin, image)...)
+	default:
+		err = b.acbuild(begin...)
+		if err == nil {
+			err = b.acbuild("dependency", "add", "docker://"+image)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	b.begun = true
+	if b.mode == lib.BuildModeAppC {
+		return b.acbuild("set-name", b.name)
+	}
+	return nil
+}
+
+func (b *dockerfileBuild) execRun(inst dockerfile.Instruction) error {
+	var exec []string
+	if inst.JSON {
+		exec = inst.JSONArgs
+	} else {
+		// Build arguments are visible to commands as environment variables,
+		// which the shell form can export itself.
+		var exports []string
+		for _, name := range b.argOrder {
+			if _, ok := b.env[name]; ok {
+				continue
+			}
+			if val, ok := b.buildArg[name]; ok {
+				exports = append(exports, name+"="+shellQuote(val))
+			}
+		}
+		command := inst.Args
+		if len(exports) != 0 {
+			command = "export " + strings.Join(dedupe(exports), " ") + "; " + command
+		}
+		exec = append(append([]string{}, b.shell...), command)
+	}
+	run := []string{"run", "--engine=" + b.engine, "--working-dir=" + b.workdir}
+	if b.insecure {
+		run = append(run, "--insecure")
+	}
+	return b.acbuild(append(append(run, "--"), exec...)...)
+}
+
+func (b *dockerfileBuild) execCopy(inst dockerfile.Instruction) error {
+	words, err := b.words(inst)
+	if err != nil {
+		return err
+	}
+	if len(words) < 2 {
+		return fmt.Errorf("expected at least one source and a destination")
+	}
+	srcs, dest := words[:len(words)-1], words[len(words)-1]
+	toDir := len(srcs) > 1 || strings.HasSuffix(dest, "/")
+	dest = b.resolve(dest)
+
+	var paths []string
+	for _, src := range srcs {
+		if inst.Command == "ADD" && (strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")) {
+			return fmt.Errorf("adding files from URLs is not supported")
+		}
+		matches, err := filepath.Glob(filepath.Join(b.context, src))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%s: no such file or directory in the build context", src)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if m != b.context && !strings.HasPrefix(m, b.context+string(filepath.Separator)) {
+				return fmt.Errorf("%s is outside of the build context", src)
+			}
+			paths = append(paths, m)
+		}
+	}
+	if len(paths) > 1 {
+		toDir = true
+	}
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if inst.Command == "ADD" && !info.IsDir() && isArchive(p) {
+			return fmt.Errorf("extracting local archives is not supported, use COPY with the extracted files")
+		}
+		switch {
+		case info.IsDir():
+			// The contents of a directory are copied, not the directory
+			// itself.
+			err = b.acbuild("copy", p, dest)
+		case toDir:
+			err = b.acbuild("copy-to-dir", p, dest)
+		default:
+			err = b.acbuild("copy", p, dest)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *dockerfileBuild) execExpose(inst dockerfile.Instruction) error {
+	words, err := b.words(inst)
+	if err != nil {
+		return err
+	}
+	for _, w := range words {
+		proto := "tcp"
+		if i := strings.Index(w, "/"); i != -1 {
+			w, proto = w[:i], strings.ToLower(w[i+1:])
+		}
+		first, last := w, w
+		if i := strings.Index(w, "-"); i != -1 {
+			first, last = w[:i], w[i+1:]
+		}
+		start, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", w)
+		}
+		end, err := strconv.ParseUint(last, 10, 16)
+		if err != nil || end < start {
+			return fmt.Errorf("invalid port %q", w)
+		}
+
+		name := proto + "-" + w
+		if _, ok := b.exposed[name]; ok {
+			continue
+		}
+		b.exposed[name] = struct{}{}
+		args := []string{"port", "add", name, proto, first}
+		if end != start {
+			args = append(args, "--count="+strconv.FormatUint(end-start+1, 10))
+		}
+		err = b.acbuild(args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execForm returns the command given to CMD or ENTRYPOINT, running the shell
+// form with the shell.
+func (b *dockerfileBuild) execForm(inst dockerfile.Instruction) ([]string, error) {
+	if inst.JSON {
+		return inst.JSONArgs, nil
+	}
+	if inst.Args == "" {
+		return nil, nil
+	}
+	return append(append([]string{}, b.shell...), inst.Args), nil
+}
+
+// resolve makes p absolute against the current working directory of the
+// Dockerfile.
+func (b *dockerfileBuild) resolve(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(b.workdir, p)
+}
+
+func isArchive(p string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz"} {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// dedupe removes all but the last NAME= assignment for each name.
+func dedupe(assignments []string) []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for i := len(assignments) - 1; i >= 0; i-- {
+		name := strings.SplitN(assignments[i], "=", 2)[0]
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		out = append([]string{assignments[i]}, out...)
+	}
+	return out
+}
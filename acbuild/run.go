@@ -17,19 +17,24 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/containers/build/engine"
 	"github.com/containers/build/engine/chroot"
 	"github.com/containers/build/engine/systemdnspawn"
+	"github.com/containers/build/lib"
+	"github.com/containers/build/registry"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	insecure   = false
-	workingdir = ""
-	engineName = ""
-	cmdRun     = &cobra.Command{
+	insecure     = false
+	fetchRetries = 0
+	fetchTimeout time.Duration
+	workingdir   = ""
+	engineName   = ""
+	cmdRun       = &cobra.Command{
 		Use:     "run -- CMD [ARGS]",
 		Short:   "Run a command in the image, saving changes made",
 		Example: "acbuild run -- yum install nginx",
@@ -52,6 +57,8 @@ func init() {
 	engineList := fmt.Sprintf("[%s]", strings.Join(engineNames, ","))
 
 	cmdRun.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http")
+	cmdRun.Flags().IntVar(&fetchRetries, "fetch-retries", registry.DefaultRetries, "How many times to retry a failed download of a dependency")
+	cmdRun.Flags().DurationVar(&fetchTimeout, "fetch-timeout", registry.DefaultTimeout, "How long to wait on a stalled download of a dependency")
 	cmdRun.Flags().StringVar(&workingdir, "working-dir", "", "The working directory inside the container for this command")
 	cmdRun.Flags().StringVar(&engineName, "engine", "systemd-nspawn", "The engine used to run the command. Supported engines: "+engineList)
 }
@@ -77,6 +84,7 @@ func runRun(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
+	setFetchOptions(a)
 	err = a.Run(args, workingdir, insecure, engine)
 
 	if err != nil {
@@ -86,3 +94,14 @@ func runRun(cmd *cobra.Command, args []string) (exit int) {
 
 	return 0
 }
+
+// setFetchOptions configures how a will download images from the --fetch-*
+// flags.
+func setFetchOptions(a *lib.ACBuild) {
+	a.FetchRetries = fetchRetries
+	if fetchRetries == 0 {
+		// The registry treats zero as "use the default"
+		a.FetchRetries = -1
+	}
+	a.FetchTimeout = fetchTimeout
+}
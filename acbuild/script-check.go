@@ -0,0 +1,332 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/containers/build/lib"
+)
+
+var (
+	// appcOnlyCommands are the commands, by their path under acbuild, that
+	// only work in appc builds.
+	appcOnlyCommands = map[string]bool{
+		"isolator add":                true,
+		"isolator remove":             true,
+		"set-name":                    true,
+		"set-event-handler pre-start": true,
+		"set-event-handler post-stop": true,
+		"dependency lock":             true,
+		"dependency tree":             true,
+		"dependency list":             true,
+	}
+
+	// appcOnlyFlags are the flags of commands that only work in appc builds.
+	appcOnlyFlags = map[string][]string{
+		"dependency add": {"image-id", "label", "size"},
+		"port add":       {"count", "socket-activated"},
+	}
+)
+
+// argCount is how many arguments a command accepts. A max of -1 means there's
+// no limit.
+type argCount struct {
+	min, max int
+}
+
+// commandArgCount works out how many arguments cmd accepts from its usage
+// line. "[ARG]" is optional, "[ARGS]" is any number of arguments, and "..."
+// repeats the argument before it.
+func commandArgCount(cmd *cobra.Command) argCount {
+	var count argCount
+	for _, word := range strings.Fields(cmd.Use)[1:] {
+		switch {
+		case word == "--":
+		case word == "...":
+			count.min--
+			count.max = -1
+		case strings.HasPrefix(word, "[") && strings.HasSuffix(word, "S]"):
+			count.max = -1
+		case strings.HasPrefix(word, "["):
+			if count.max != -1 {
+				count.max++
+			}
+		default:
+			count.min++
+			if count.max != -1 {
+				count.max++
+			}
+		}
+	}
+	return count
+}
+
+func (c argCount) String() string {
+	switch {
+	case c.max == -1:
+		return fmt.Sprintf("at least %d", c.min)
+	case c.min == c.max:
+		return fmt.Sprintf("%d", c.min)
+	}
+	return fmt.Sprintf("%d to %d", c.min, c.max)
+}
+
+// scriptChecker validates scripts without running them.
+type scriptChecker struct {
+	problems []string
+
+	// stages holds the state of each stage by name, the stage before the
+	// first STAGE line being "".
+	stages  map[string]*checkedStage
+	current *checkedStage
+
+	// active holds the scripts being checked, to catch scripts that call
+	// themselves.
+	active map[string]bool
+}
+
+type checkedStage struct {
+	begun bool
+	wrote bool
+	mode  lib.BuildMode
+}
+
+func newScriptChecker() *scriptChecker {
+	current := &checkedStage{}
+	return &scriptChecker{
+		stages:  map[string]*checkedStage{"": current},
+		current: current,
+		active:  make(map[string]bool),
+	}
+}
+
+func (c *scriptChecker) report(file string, num int, format string, a ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf("%s:%d: %s", file, num, fmt.Sprintf(format, a...)))
+}
+
+// checkScript checks every line of a script, including the scripts it calls,
+// and then checks that the build as a whole makes sense.
+func checkScript(name string, rawScript []byte, args map[string]string) []string {
+	c := newScriptChecker()
+	c.checkLines(name, rawScript, args)
+
+	begun, wrote := false, false
+	for _, stage := range c.stages {
+		begun = begun || stage.begun
+		wrote = wrote || stage.wrote
+	}
+	if !begun {
+		c.problems = append(c.problems, fmt.Sprintf("%s: the script never calls begin", name))
+	}
+	if !wrote {
+		c.problems = append(c.problems, fmt.Sprintf("%s: the script never calls write", name))
+	}
+	return c.problems
+}
+
+func (c *scriptChecker) checkLines(name string, rawScript []byte, args map[string]string) {
+	abs, err := filepath.Abs(name)
+	if err == nil {
+		if c.active[abs] {
+			c.problems = append(c.problems, fmt.Sprintf("%s: the script calls itself", name))
+			return
+		}
+		c.active[abs] = true
+		defer delete(c.active, abs)
+	}
+
+	vars := newScriptVars(args)
+	for _, l := range splitLines(string(rawScript)) {
+		tokens, err := tokenizeAndExpand(l.text, vars)
+		if err != nil {
+			c.report(name, l.num, "%v", err)
+			continue
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		switch strings.ToLower(tokens[0]) {
+		case "arg", "set", "stage":
+			c.checkDeclaration(name, l.num, tokens, vars)
+			continue
+		case "include":
+			c.checkInclude(name, l.num, tokens)
+			continue
+		}
+		if l.heredoc != nil {
+			if _, err := addHeredoc(tokens, l.heredoc, vars); err != nil {
+				c.report(name, l.num, "%s: %v", strings.ToLower(tokens[0]), err)
+			}
+		}
+		c.checkCommand(name, l.num, tokens)
+	}
+}
+
+func (c *scriptChecker) checkDeclaration(name string, num int, tokens []string, vars *scriptVars) {
+	keyword := strings.ToUpper(tokens[0])
+	if keyword == "STAGE" {
+		switch {
+		case len(tokens) != 2:
+			c.report(name, num, "STAGE: expected a single name")
+		case !stageNameRegexp.MatchString(tokens[1]):
+			c.report(name, num, "STAGE: invalid stage name %q", tokens[1])
+		case c.stages[tokens[1]] != nil:
+			c.report(name, num, "STAGE: stage %q already exists", tokens[1])
+		default:
+			c.current = &checkedStage{}
+			c.stages[tokens[1]] = c.current
+		}
+		return
+	}
+
+	declare := vars.declareArg
+	if keyword == "SET" {
+		declare = vars.set
+	}
+	if len(tokens) == 1 {
+		c.report(name, num, "%s: nothing to declare", keyword)
+	}
+	for _, decl := range tokens[1:] {
+		err := declare(decl)
+		if err != nil {
+			c.report(name, num, "%s: %v", keyword, err)
+		}
+	}
+}
+
+// checkCommand checks a line calling an acbuild command against the command
+// tree, without running it.
+func (c *scriptChecker) checkCommand(name string, num int, tokens []string) {
+	tokens[0] = strings.ToLower(tokens[0])
+	if tokens[0] == "run" || tokens[0] == "set-exec" {
+		tokens = insertRunTacks(tokens)
+	}
+
+	cmd, rest, err := cmdAcbuild.Find(tokens)
+	if err != nil || cmd == cmdAcbuild {
+		c.report(name, num, "unknown command %q", tokens[0])
+		return
+	}
+	path := strings.TrimPrefix(cmd.CommandPath(), cmdAcbuild.Name()+" ")
+	if !cmd.Runnable() {
+		if len(rest) == 0 {
+			c.report(name, num, "%s: missing subcommand", path)
+		} else {
+			c.report(name, num, "%s: unknown subcommand %q", path, rest[0])
+		}
+		return
+	}
+
+	// Parsing the flags sets them, so they need resetting afterwards.
+	defer resetFlags(cmdAcbuild)
+	err = cmd.ParseFlags(rest)
+	if err != nil {
+		c.report(name, num, "%s: %v", path, err)
+		return
+	}
+
+	args := cmd.Flags().Args()
+	count := commandArgCount(cmd)
+	if len(args) < count.min || (count.max != -1 && len(args) > count.max) {
+		c.report(name, num, "%s: expected %s arguments, got %d", path, count, len(args))
+	}
+
+	stage := c.current
+	switch path {
+	case "end":
+		c.report(name, num, "end: calling end is unnecessary in a script, cleanup is done automatically")
+		return
+	case "begin":
+		if stage.begun {
+			c.report(name, num, "begin: build already in progress")
+		}
+		stage.begun = true
+		stage.mode = lib.BuildMode(cmd.Flags().Lookup("build-mode").Value.String())
+		if stage.mode != lib.BuildModeAppC && stage.mode != lib.BuildModeOCI {
+			c.report(name, num, "begin: invalid build mode: %s", stage.mode)
+		}
+		return
+	case "script":
+		c.checkNested(name, num, cmd, args)
+		return
+	case "version", "gen-man-pages", "dockerfile build":
+		return
+	}
+
+	if !stage.begun {
+		c.report(name, num, "%s: no build in progress, call begin first", path)
+		return
+	}
+	if path == "write" {
+		stage.wrote = true
+	}
+	if stage.mode == lib.BuildModeOCI {
+		if appcOnlyCommands[path] {
+			c.report(name, num, "%s: only supported in appc builds", path)
+		}
+		for _, flag := range appcOnlyFlags[path] {
+			if cmd.Flags().Changed(flag) {
+				c.report(name, num, "%s: --%s is only supported in appc builds", path, flag)
+			}
+		}
+	}
+}
+
+// checkNested checks a script called with the script command.
+func (c *scriptChecker) checkNested(name string, num int, cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		return
+	}
+	rawScript, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		c.report(name, num, "script: %v", err)
+		return
+	}
+	nestedArgs := make(map[string]string)
+	for argName, val := range scriptArgs {
+		nestedArgs[argName] = val
+	}
+	c.checkLines(args[0], rawScript, nestedArgs)
+}
+
+// checkInclude checks a fragment included with the include directive.
+func (c *scriptChecker) checkInclude(name string, num int, tokens []string) {
+	if len(tokens) < 2 {
+		c.report(name, num, "include: expected the path of a script to include")
+		return
+	}
+	path := includePath(name, tokens[1])
+	params, err := includeParams(tokens[2:])
+	if err != nil {
+		c.report(name, num, "include: %v", err)
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil && c.active[abs] {
+		c.report(name, num, "include: %s is already being included", path)
+		return
+	}
+	rawScript, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.report(name, num, "include: %v", err)
+		return
+	}
+	c.checkLines(path, rawScript, params)
+}
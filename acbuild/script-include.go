@@ -0,0 +1,116 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// scriptFile is a script or included fragment being run.
+type scriptFile struct {
+	name string
+	abs  string
+}
+
+// scriptFiles holds the scripts and fragments being run, outermost first, to
+// catch scripts that include or call themselves.
+var scriptFiles []scriptFile
+
+// pushScriptFile records that the script name is being run, returning a
+// function that undoes it. It fails if name is already being run.
+func pushScriptFile(name string) (func(), error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range scriptFiles {
+		if f.abs != abs {
+			continue
+		}
+		var chain []string
+		for _, f := range scriptFiles[i:] {
+			chain = append(chain, f.name)
+		}
+		chain = append(chain, name)
+		return nil, fmt.Errorf("cycle: %s", strings.Join(chain, " -> "))
+	}
+	scriptFiles = append(scriptFiles, scriptFile{name, abs})
+	return func() { scriptFiles = scriptFiles[:len(scriptFiles)-1] }, nil
+}
+
+// includePath returns the path of the fragment included by the script name,
+// which is relative to the directory name is in.
+func includePath(name, fragment string) string {
+	if filepath.IsAbs(fragment) {
+		return fragment
+	}
+	return filepath.Join(filepath.Dir(name), fragment)
+}
+
+// includeParams parses the KEY=VALUE parameters of an include line.
+func includeParams(decls []string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, decl := range decls {
+		key, val, ok := splitVarDecl(decl)
+		if !ok || !varNameRegexp.MatchString(key) {
+			return nil, fmt.Errorf("invalid parameter %q, expected KEY=VALUE", decl)
+		}
+		params[key] = val
+	}
+	return params, nil
+}
+
+// execInclude runs the lines of the fragment included by an include line of
+// the script name, in the current build. The fragment's ARG declarations take
+// their values from the parameters given after its path.
+func execInclude(name string, tokens []string, trace bool) error {
+	if len(tokens) < 2 {
+		return fmt.Errorf("expected the path of a script to include")
+	}
+	path := includePath(name, tokens[1])
+	params, err := includeParams(tokens[2:])
+	if err != nil {
+		return err
+	}
+	rawScript, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pop, err := pushScriptFile(path)
+	if err != nil {
+		return err
+	}
+	defer pop()
+
+	steps := scriptSteps(rawScript)
+	err = checkSteps(path, steps)
+	if err != nil {
+		return err
+	}
+	vars := newScriptVars(params)
+	for _, l := range steps {
+		err := execStep(path, l, vars, trace)
+		if err != nil {
+			return err
+		}
+	}
+	for _, param := range vars.unusedArgs() {
+		stderr("script: warning: %s: parameter %s was never declared with ARG", path, param)
+	}
+	return nil
+}
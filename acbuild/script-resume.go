@@ -0,0 +1,140 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// keepDirName is the directory, in the work path, where the builds of a
+	// script run with --keep-on-failure are kept.
+	keepDirName   = ".acbuild-script"
+	keepStateName = "state.json"
+)
+
+// scriptState records how far a script kept with --keep-on-failure got, so
+// that it can be resumed with --resume.
+type scriptState struct {
+	// Script is the absolute path of the script that failed.
+	Script string `json:"script"`
+	// Completed is how many steps of the script succeeded.
+	Completed int `json:"completed"`
+	// Hash is the hash of the build arguments and the completed steps.
+	Hash string `json:"hash"`
+
+	WorkPath   string            `json:"workPath"`
+	Stages     map[string]string `json:"stages"`
+	StagePaths []string          `json:"stagePaths"`
+}
+
+// scriptHash returns the hash of a script's build arguments and steps, which
+// changes if any of them are edited.
+func scriptHash(args map[string]string, steps []scriptLine) string {
+	h := sha256.New()
+	var names []string
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, args[name])
+	}
+	for _, step := range steps {
+		fmt.Fprintf(h, "\x00%s\n", step.text)
+		if step.heredoc != nil {
+			fmt.Fprintf(h, "<<%s\n%s", step.heredoc.delim, step.heredoc.text)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// saveScriptState records that the script name failed after completing the
+// given number of steps, along with the stages of the running script.
+func saveScriptState(keepPath, name string, args map[string]string, steps []scriptLine, completed int) error {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	state := &scriptState{
+		Script:     abs,
+		Completed:  completed,
+		Hash:       scriptHash(args, steps[:completed]),
+		WorkPath:   scriptWorkPath,
+		Stages:     scriptStages,
+		StagePaths: scriptStagePaths,
+	}
+	blob, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(keepPath, keepStateName), blob, 0644)
+}
+
+// loadScriptState reads the state of the failed script kept in keepPath.
+func loadScriptState(keepPath string) (*scriptState, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(keepPath, keepStateName))
+	if err != nil {
+		return nil, err
+	}
+	state := &scriptState{}
+	err = json.Unmarshal(blob, state)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", filepath.Join(keepPath, keepStateName), err)
+	}
+	return state, nil
+}
+
+// check returns an error if the script name can't be resumed from state,
+// because it's a different script or the steps that already succeeded have
+// changed.
+func (state *scriptState) check(name string, args map[string]string, steps []scriptLine) error {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if abs != state.Script {
+		return fmt.Errorf("the failed script being kept is %s, not %s", state.Script, abs)
+	}
+	if state.Completed > len(steps) || scriptHash(args, steps[:state.Completed]) != state.Hash {
+		return fmt.Errorf("the first %d steps of %s or its build arguments have changed since it failed, run it again without --resume", state.Completed, name)
+	}
+	return nil
+}
+
+// restore switches the running script to the stages recorded in state.
+func (state *scriptState) restore() {
+	scriptStages = state.Stages
+	if scriptStages == nil {
+		scriptStages = make(map[string]string)
+	}
+	scriptStagePaths = state.StagePaths
+	scriptWorkPath = state.WorkPath
+	contextpath = state.WorkPath
+}
+
+// keptScriptExists returns whether keepPath holds the builds of a failed
+// script.
+func keptScriptExists(keepPath string) bool {
+	_, err := os.Stat(keepPath)
+	return err == nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	errUnterminatedVar = fmt.Errorf("unterminated variable reference")
+
+	varNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// scriptVars holds the variables defined while running a script, along with
+// the build arguments it was given.
+type scriptVars struct {
+	vars map[string]string
+	args map[string]string
+	used map[string]struct{}
+}
+
+func newScriptVars(args map[string]string) *scriptVars {
+	if args == nil {
+		args = make(map[string]string)
+	}
+	return &scriptVars{
+		vars: make(map[string]string),
+		args: args,
+		used: make(map[string]struct{}),
+	}
+}
+
+// declareArg handles an ARG declaration of the form NAME or NAME=default. The
+// variable takes the value of the build argument with the same name if one
+// was given, and otherwise the default. Without either it stays undefined.
+func (v *scriptVars) declareArg(decl string) error {
+	name, def, hasDefault := splitVarDecl(decl)
+	if !varNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+	if val, ok := v.args[name]; ok {
+		v.used[name] = struct{}{}
+		v.vars[name] = val
+	} else if hasDefault {
+		v.vars[name] = def
+	}
+	return nil
+}
+
+// set handles a SET declaration of the form NAME=VALUE.
+func (v *scriptVars) set(decl string) error {
+	name, val, ok := splitVarDecl(decl)
+	if !ok {
+		return fmt.Errorf("no '=' character in %q", decl)
+	}
+	if !varNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+	v.vars[name] = val
+	return nil
+}
+
+// unusedArgs returns the names of the build arguments that no ARG declaration
+// asked for.
+func (v *scriptVars) unusedArgs() []string {
+	var unused []string
+	for name := range v.args {
+		if _, ok := v.used[name]; !ok {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// expand returns the value of the variable reference expr, which is what was
+// found between "${" and "}". It is either a variable name, or of the form
+// NAME:-default where the default is used if the variable is undefined or
+// empty.
+func (v *scriptVars) expand(expr string) (string, error) {
+	name, def, hasDefault := expr, "", false
+	if i := strings.Index(expr, ":-"); i != -1 {
+		name, def, hasDefault = expr[:i], expr[i+2:], true
+	}
+	if !varNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid variable reference ${%s}", expr)
+	}
+	val, ok := v.vars[name]
+	switch {
+	case ok && (val != "" || !hasDefault):
+		return val, nil
+	case hasDefault:
+		return v.expandString(def)
+	}
+	return "", fmt.Errorf("undefined variable %q", name)
+}
+
+// expandString expands every variable reference in s.
+func (v *scriptVars) expandString(s string) (string, error) {
+	var out []rune
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '$' || i+1 == len(runes) || runes[i+1] != '{' {
+			out = append(out, runes[i])
+			continue
+		}
+		expr, end, err := varReference(runes, i)
+		if err != nil {
+			return "", err
+		}
+		val, err := v.expand(expr)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, []rune(val)...)
+		i = end
+	}
+	return string(out), nil
+}
+
+// varReference returns the contents of the variable reference starting with
+// the "${" at runes[start], and the index of its closing brace.
+func varReference(runes []rune, start int) (string, int, error) {
+	depth := 0
+	for i := start + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return string(runes[start+2 : i]), i, nil
+			}
+		}
+	}
+	return "", 0, errUnterminatedVar
+}
+
+func splitVarDecl(decl string) (string, string, bool) {
+	parts := strings.SplitN(decl, "=", 2)
+	if len(parts) != 2 {
+		return parts[0], "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// buildArgs holds the build arguments given to the script command with --arg.
+type buildArgs map[string]string
+
+func (b *buildArgs) String() string {
+	var strArgs []string
+	for name, val := range *b {
+		strArgs = append(strArgs, name+"="+val)
+	}
+	sort.Strings(strArgs)
+	return strings.Join(strArgs, " ")
+}
+
+func (b *buildArgs) Set(input string) error {
+	name, val, ok := splitVarDecl(input)
+	if !ok {
+		return fmt.Errorf("no '=' character in %q", input)
+	}
+	if !varNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid build argument name %q", name)
+	}
+	if *b == nil {
+		*b = make(buildArgs)
+	}
+	(*b)[name] = val
+	return nil
+}
+
+func (b *buildArgs) reset() {
+	*b = nil
+}
+
+func (b *buildArgs) Type() string {
+	return "BuildArgs"
+}
@@ -19,30 +19,79 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
-)
+	"github.com/spf13/pflag"
 
-const (
-	nestedScriptEnvVar = "ACBUILD_NESTED_SCRIPT"
+	"github.com/containers/build/lib"
 )
 
 var (
+	// scriptDepth is how many scripts are currently being run, counting
+	// scripts called from other scripts.
+	scriptDepth int
+
+	// scriptWorkPath is the work path of the build the running script is
+	// operating on, which changes when the script starts a new stage.
+	scriptWorkPath string
+
+	// scriptStages maps the names of the stages of the running script to
+	// their work paths, and scriptStagePaths lists the work paths of every
+	// build the script may have begun.
+	scriptStages     map[string]string
+	scriptStagePaths []string
+
+	// scriptBuild is shared by every line of the script being run once the
+	// build has begun, so that the build's lock is only taken and its
+	// manifest only loaded once.
+	scriptBuild *lib.ACBuild
+
+	// scriptKeepPath is where the builds of the running script are kept if it
+	// fails, or "" if they're thrown away.
+	scriptKeepPath string
+
 	errSingleQuote = fmt.Errorf("unterminated single quote block")
 	errDoubleQuote = fmt.Errorf("unterminated double quote block")
 	errEscape      = fmt.Errorf("ended with an escape")
-	cmdScript      = &cobra.Command{
+
+	stageNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	heredocRegexp   = regexp.MustCompile(`(?:^|\s)<<(-?)(?:'(\w+)'|"(\w+)"|(\w+))$`)
+
+	// scriptTracing is set while running a script with --trace, so that
+	// scripts called from it are traced too.
+	scriptTracing bool
+
+	// nestedScriptErr holds the error of the last script called from another
+	// script, for the calling line to report.
+	nestedScriptErr error
+
+	scriptArgs  buildArgs
+	scriptTrace bool
+	scriptCheck bool
+
+	scriptKeepOnFailure bool
+	scriptResume        bool
+
+	cmdScript = &cobra.Command{
 		Use:     "script SCRIPT_FILE",
 		Short:   "Runs an acbuild script",
-		Example: "acbuild script build-myapp.acb",
+		Example: "acbuild script --arg VERSION=1.2 build-myapp.acb",
 		Run:     runWrapper(runScript),
 	}
 )
 
 func init() {
 	cmdAcbuild.AddCommand(cmdScript)
+
+	cmdScript.Flags().Var(&scriptArgs, "arg", "Build argument of the form NAME=VALUE, for ARG declarations in the script")
+	cmdScript.Flags().BoolVar(&scriptTrace, "trace", false, "Print each command, with its variables expanded, before running it")
+	cmdScript.Flags().BoolVar(&scriptCheck, "check", false, "Check the script for mistakes without running it")
+	cmdScript.Flags().BoolVar(&scriptKeepOnFailure, "keep-on-failure", false, "Keep the build if the script fails, so that it can be resumed")
+	cmdScript.Flags().BoolVar(&scriptResume, "resume", false, "Resume a script kept with --keep-on-failure from the step that failed")
 }
 
 func runScript(cmd *cobra.Command, args []string) (exit int) {
@@ -51,46 +100,310 @@ func runScript(cmd *cobra.Command, args []string) (exit int) {
 		return 1
 	}
 
+	// A script called from another one reports its error through the line
+	// that called it, instead of printing it here.
+	nested := scriptDepth > 0
+	fail := func(err error) int {
+		if nested {
+			nestedScriptErr = err
+			return getErrorCode(err)
+		}
+		stderr("script: %v", err)
+		if se, ok := innermostScriptError(err); ok {
+			stderr("\t%s", se.text)
+		}
+		return getErrorCode(err)
+	}
+
 	scriptName := args[0]
 	rawScript, err := ioutil.ReadFile(scriptName)
 	if err != nil {
-		stderr("script: %v", err)
-		return getErrorCode(err)
+		return fail(err)
 	}
 
 	if debug {
 		stderr("Running script from %s", scriptName)
 	}
 
-	err = execScript(rawScript)
+	argMap := make(map[string]string)
+	for name, val := range scriptArgs {
+		argMap[name] = val
+	}
+
+	if scriptCheck {
+		problems := checkScript(scriptName, rawScript, argMap)
+		for _, problem := range problems {
+			stderr("%s", problem)
+		}
+		if len(problems) != 0 {
+			return fail(fmt.Errorf("found %d problems in %s", len(problems), scriptName))
+		}
+		return 0
+	}
+
+	var resume *scriptState
+	if scriptKeepOnFailure || scriptResume {
+		if nested {
+			return fail(fmt.Errorf("--keep-on-failure and --resume can't be used in a script called from another script"))
+		}
+		keepPath, err := filepath.Abs(filepath.Join(contextpath, keepDirName))
+		if err != nil {
+			return fail(err)
+		}
+		if scriptResume {
+			resume, err = loadScriptState(keepPath)
+			if os.IsNotExist(err) {
+				return fail(fmt.Errorf("there is no failed script to resume in %s", keepPath))
+			}
+			if err != nil {
+				return fail(err)
+			}
+			err = resume.check(scriptName, argMap, scriptSteps(rawScript))
+			if err != nil {
+				return fail(err)
+			}
+		} else if keptScriptExists(keepPath) {
+			return fail(fmt.Errorf("%s holds the build of a failed script, resume it with --resume or remove it", keepPath))
+		}
+		scriptKeepPath = keepPath
+		defer func() { scriptKeepPath = "" }()
+	}
+
+	trace := scriptTrace || (nested && scriptTracing)
+	err = execScript(scriptName, rawScript, argMap, trace, resume)
 	if err != nil {
-		stderr("script: %v", err)
-		return getErrorCode(err)
+		code := fail(err)
+		if scriptKeepPath != "" && keptScriptExists(scriptKeepPath) {
+			stderr("script: the build was kept in %s, fix the script and run it again with --resume", scriptKeepPath)
+		}
+		return code
 	}
 	return 0
 }
 
-func execScript(rawScript []byte) error {
-	script := strings.Split(string(rawScript), "\n")
-	for i, s := range script {
-		s = strings.TrimSpace(s)
-		script[i] = s
+// scriptLine is a line of a script, with any continuation lines joined to it.
+type scriptLine struct {
+	// num is the line number the line starts on.
+	num  int
+	text string
 
-		if strings.HasPrefix(strings.ToLower(s), "run") && os.Geteuid() != 0 {
-			return fmt.Errorf("scripts using the run subcommand must be run as root")
+	// heredoc holds the heredoc that follows the line, if it ends with one.
+	heredoc *heredoc
+}
+
+// heredoc is a block of text given to a line of a script, written as
+//
+//	write-file /etc/app.conf <<EOF
+//	...
+//	EOF
+//
+// Variables are expanded in the text unless the delimiter is quoted, and with
+// <<- leading tabs are removed from each line.
+type heredoc struct {
+	delim      string
+	text       string
+	expand     bool
+	terminated bool
+}
+
+// scriptError is the error a line of a script failed with.
+type scriptError struct {
+	file string
+	scriptLine
+	cmd string
+	err error
+}
+
+func (e *scriptError) Error() string {
+	if e.cmd == "" {
+		return fmt.Sprintf("%s:%d: %v", e.file, e.num, e.err)
+	}
+	return fmt.Sprintf("%s:%d: %s: %v", e.file, e.num, e.cmd, e.err)
+}
+
+// innermostScriptError returns the error of the line that failed first, which
+// is in a nested script if err came from a line calling one.
+func innermostScriptError(err error) (*scriptError, bool) {
+	se, ok := err.(*scriptError)
+	if !ok {
+		return nil, false
+	}
+	if inner, ok := innermostScriptError(se.err); ok {
+		return inner, true
+	}
+	return se, true
+}
+
+// execScript runs a script. If resume is set, the steps that succeeded before
+// are skipped, apart from their variable declarations.
+func execScript(name string, rawScript []byte, args map[string]string, trace bool, resume *scriptState) error {
+	steps := scriptSteps(rawScript)
+	err := checkSteps(name, steps)
+	if err != nil {
+		return err
+	}
+	pop, err := pushScriptFile(name)
+	if err != nil {
+		return err
+	}
+	defer pop()
+
+	oldTracing := scriptTracing
+	scriptTracing = trace
+	defer func() { scriptTracing = oldTracing }()
+
+	keep := scriptKeepPath != "" && scriptDepth == 0
+	return inScriptBuild(func(string) error {
+		vars := newScriptVars(args)
+		start := 0
+		if resume != nil {
+			resume.restore()
+			start = resume.Completed
+			for _, l := range steps[:start] {
+				tokens, err := tokenizeAndExpand(l.text, vars)
+				if err != nil {
+					return &scriptError{name, l, "", err}
+				}
+				if len(tokens) == 0 {
+					continue
+				}
+				switch strings.ToLower(tokens[0]) {
+				case "arg", "set":
+					err = execLine(scriptWorkPath, tokens, vars)
+					if err != nil {
+						return &scriptError{name, l, strings.ToLower(tokens[0]), err}
+					}
+				}
+			}
+		}
+		for i := start; i < len(steps); i++ {
+			err := execStep(name, steps[i], vars, trace)
+			if err != nil {
+				if keep {
+					err1 := saveScriptState(scriptKeepPath, name, args, steps, i)
+					if err1 != nil {
+						stderr("script: %v", err1)
+					}
+				}
+				return err
+			}
 		}
+		for _, name := range vars.unusedArgs() {
+			stderr("script: warning: build argument %s was never declared with ARG", name)
+		}
+		return nil
+	})
+}
 
-		if strings.HasPrefix(strings.ToLower(s), "end") {
-			return fmt.Errorf("calling end is unnecessary in a script, cleanup is done automatically")
+// checkSteps returns an error for the lines of a script that can't be run.
+func checkSteps(name string, steps []scriptLine) error {
+	for _, l := range steps {
+		lower := strings.ToLower(l.text)
+		if strings.HasPrefix(lower, "run") && os.Geteuid() != 0 {
+			return &scriptError{name, l, "run", fmt.Errorf("scripts using the run subcommand must be run as root")}
+		}
+
+		if strings.HasPrefix(lower, "end") {
+			return &scriptError{name, l, "end", fmt.Errorf("calling end is unnecessary in a script, cleanup is done automatically")}
 		}
 	}
-	script = joinLines(script)
+	return nil
+}
 
+// execStep runs a single line of a script.
+func execStep(name string, l scriptLine, vars *scriptVars, trace bool) error {
+	tokens, err := tokenizeAndExpand(l.text, vars)
+	if err != nil {
+		return &scriptError{name, l, "", err}
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	if trace {
+		traced := formatTokens(tokens)
+		if l.heredoc != nil {
+			traced += " <<" + l.heredoc.delim
+		}
+		stderr("+ %s:%d: %s", name, l.num, traced)
+	}
+	if l.heredoc != nil {
+		tokens, err = addHeredoc(tokens, l.heredoc, vars)
+		if err != nil {
+			return &scriptError{name, l, strings.ToLower(tokens[0]), err}
+		}
+	}
+	if strings.ToLower(tokens[0]) == "include" {
+		err = execInclude(name, tokens, trace)
+	} else {
+		err = execLine(scriptWorkPath, tokens, vars)
+	}
+	if err != nil {
+		return &scriptError{name, l, strings.ToLower(tokens[0]), err}
+	}
+	return nil
+}
+
+// addHeredoc passes the text of h to the command in tokens, which must be
+// write-file, as its contents.
+func addHeredoc(tokens []string, h *heredoc, vars *scriptVars) ([]string, error) {
+	if strings.ToLower(tokens[0]) != "write-file" {
+		return tokens, fmt.Errorf("only write-file takes a heredoc")
+	}
+	if !h.terminated {
+		return tokens, fmt.Errorf("heredoc is never terminated, expected a line with %s", h.delim)
+	}
+	text := h.text
+	if h.expand {
+		var err error
+		text, err = vars.expandString(text)
+		if err != nil {
+			return tokens, err
+		}
+	}
+	return append([]string{tokens[0], "--content=" + text}, tokens[1:]...), nil
+}
+
+// scriptSteps returns the lines of a script that do something, leaving out
+// comments.
+func scriptSteps(rawScript []byte) []scriptLine {
+	var steps []scriptLine
+	for _, l := range splitLines(string(rawScript)) {
+		if !strings.HasPrefix(l.text, "#") {
+			steps = append(steps, l)
+		}
+	}
+	return steps
+}
+
+// formatTokens returns tokens as they could be written in a script.
+func formatTokens(tokens []string) string {
+	quoted := make([]string, len(tokens))
+	for i, tok := range tokens {
+		if tok == "" || strings.ContainsAny(tok, " \t'\"\\#$") {
+			tok = strconv.Quote(tok)
+		}
+		quoted[i] = tok
+	}
+	return strings.Join(quoted, " ")
+}
+
+// inScriptBuild calls fn with the work path of the build being scripted, which
+// it can run acbuild commands against with execACBuild. Unless it is nested in
+// another script, the build is ended once fn returns. If scriptKeepPath is
+// set, the build is kept there instead of being ended when fn fails.
+func inScriptBuild(fn func(workPath string) error) error {
+	scriptDebug := debug
 	var tmpDir string
-	nestedScript := false
-	if inheritedPath := os.Getenv(nestedScriptEnvVar); inheritedPath != "" {
-		tmpDir = inheritedPath
-		nestedScript = true
+	nestedScript := scriptDepth > 0
+	keepPath := scriptKeepPath
+	if nestedScript {
+		tmpDir = scriptWorkPath
+	} else if keepPath != "" {
+		tmpDir = filepath.Join(keepPath, "build")
+		err := os.MkdirAll(tmpDir, 0755)
+		if err != nil {
+			return err
+		}
 	} else {
 		var err error
 		tmpDir, err = ioutil.TempDir("", "acbuild")
@@ -98,85 +411,329 @@ func execScript(rawScript []byte) error {
 			return err
 		}
 		defer os.RemoveAll(tmpDir)
+	}
+
+	if !nestedScript {
+		// Every line is parsed as if it was a separate invocation of acbuild,
+		// which overwrites the global flags, so put them back afterwards.
+		oldDebug, oldContextpath, oldDisableHistory := debug, contextpath, disableHistory
+		defer func() {
+			debug, contextpath, disableHistory = oldDebug, oldContextpath, oldDisableHistory
+			resetFlags(cmdAcbuild)
+		}()
+		defer func() {
+			if scriptBuild != nil {
+				err := scriptBuild.ReleaseLock()
+				if err != nil {
+					stderr("script: %v", err)
+				}
+			}
+			scriptBuild = nil
+		}()
 		contextpath = tmpDir
+		scriptWorkPath = tmpDir
+		scriptStages = make(map[string]string)
+		scriptStagePaths = []string{tmpDir}
+		defer func() {
+			if keepPath == "" {
+				for _, p := range scriptStagePaths[1:] {
+					os.RemoveAll(p)
+				}
+			}
+			scriptStages, scriptStagePaths = nil, nil
+		}()
 	}
 
-	a, err := newACBuild()
+	scriptDepth++
+	defer func() { scriptDepth-- }()
+
+	err := fn(tmpDir)
+	if nestedScript {
+		return err
+	}
+	if err != nil {
+		if keepPath != "" {
+			return err
+		}
+		err1 := endScriptBuild()
+		if err1 != nil {
+			stderr("script: %v", err1)
+		}
+		return err
+	}
+	err = endScriptBuild()
 	if err != nil {
 		return err
 	}
-	for _, line := range script {
-		if line == "" {
+	if keepPath != "" {
+		err = os.RemoveAll(keepPath)
+		if err != nil {
+			return err
+		}
+	}
+	if scriptDebug {
+		stderr("Script has been completed")
+	}
+	return nil
+}
+
+// endScriptBuild ends every build started by the script being run.
+func endScriptBuild() error {
+	var firstErr error
+	for _, workPath := range scriptStagePaths {
+		mode, err := lib.GetBuildMode(workPath)
+		if os.IsNotExist(err) {
+			// This stage failed before its build began.
 			continue
 		}
-		err := execACBuild(tmpDir, line)
-		if err != nil {
-			if !strings.HasPrefix(line, "begin") && !nestedScript {
-				err1 := a.End()
-				if err1 != nil {
-					stderr("script: %v", err1)
-				}
+		var a *lib.ACBuild
+		if err == nil {
+			if workPath == scriptWorkPath && scriptBuild != nil {
+				a = scriptBuild
+			} else {
+				a, err = lib.NewACBuild(workPath, debug, mode)
 			}
-			return err
+		}
+		if err == nil {
+			err = a.End()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	if !nestedScript {
-		err := a.End()
+	return firstErr
+}
+
+// startStage switches the running script to a new build named name, leaving
+// the current one in place so that later stages can copy files from it.
+func startStage(name string) error {
+	if !stageNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid stage name %q", name)
+	}
+	if _, ok := scriptStages[name]; ok {
+		return fmt.Errorf("stage %q already exists", name)
+	}
+
+	workPath := scriptWorkPath
+	_, err := lib.GetBuildMode(workPath)
+	if err == nil || scriptStageNamed(workPath) {
+		// The current work path is already in use.
+		if scriptKeepPath != "" {
+			workPath = filepath.Join(scriptKeepPath, "stage-"+name)
+			err = os.Mkdir(workPath, 0755)
+		} else {
+			workPath, err = ioutil.TempDir("", "acbuild-stage-")
+		}
 		if err != nil {
 			return err
 		}
-	}
-	if debug {
-		stderr("Script has been completed")
+		scriptStagePaths = append(scriptStagePaths, workPath)
 	}
 
+	if scriptBuild != nil {
+		err := scriptBuild.ReleaseLock()
+		if err != nil {
+			return err
+		}
+		scriptBuild = nil
+	}
+	scriptStages[name] = workPath
+	scriptWorkPath = workPath
+	contextpath = workPath
 	return nil
 }
 
-func execACBuild(workPath, line string) error {
-	suppliedArgs, err := tokenizeLine(line)
-	if err != nil {
-		return err
+// scriptStageNamed returns whether the build at workPath is a named stage.
+func scriptStageNamed(workPath string) bool {
+	for _, p := range scriptStages {
+		if p == workPath {
+			return true
+		}
 	}
-	if len(suppliedArgs) == 0 {
+	return false
+}
+
+// scriptStageWorkPath returns the work path of the stage of the running
+// script called name, if there is one.
+func scriptStageWorkPath(name string) (string, bool) {
+	p, ok := scriptStages[name]
+	return p, ok
+}
+
+// execLine runs a single tokenized line of a script. ARG, SET and STAGE lines
+// are handled here, anything else is an acbuild command.
+func execLine(workPath string, tokens []string, vars *scriptVars) error {
+	if len(tokens) == 0 {
 		return nil
 	}
+	var declare func(string) error
+	switch strings.ToLower(tokens[0]) {
+	case "stage":
+		if len(tokens) != 2 {
+			return fmt.Errorf("STAGE: expected a single name")
+		}
+		return startStage(tokens[1])
+	case "arg":
+		declare = vars.declareArg
+	case "set":
+		declare = vars.set
+	default:
+		return execACBuild(workPath, tokens)
+	}
+	if len(tokens) == 1 {
+		return fmt.Errorf("%s: nothing to declare", strings.ToUpper(tokens[0]))
+	}
+	for _, decl := range tokens[1:] {
+		err := declare(decl)
+		if err != nil {
+			return fmt.Errorf("%s: %v", strings.ToUpper(tokens[0]), err)
+		}
+	}
+	return nil
+}
+
+// execACBuild runs a single line of a script in this process, as if acbuild
+// had been invoked with it.
+func execACBuild(workPath string, suppliedArgs []string) error {
 	suppliedArgs[0] = strings.ToLower(suppliedArgs[0])
 	if suppliedArgs[0] == "run" || suppliedArgs[0] == "set-exec" {
 		suppliedArgs = insertRunTacks(suppliedArgs)
 	}
 	args := []string{"--debug", "--work-path=" + workPath}
 	args = append(args, suppliedArgs...)
-	cmd := exec.Command(os.Args[0], args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-	if suppliedArgs[0] == "script" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", nestedScriptEnvVar, workPath))
+
+	resetFlags(cmdAcbuild)
+	cmdExitCode = 0
+	nestedScriptErr = nil
+	cmdAcbuild.SetArgs(args)
+	err := cmdAcbuild.Execute()
+	if cmdExitCode == 0 && err != nil {
+		cmdExitCode = getErrorCode(errCobra)
 	}
-	return cmd.Run()
+	if cmdExitCode != 0 {
+		if nestedScriptErr != nil {
+			err, nestedScriptErr = nestedScriptErr, nil
+			return err
+		}
+		return exitStatus(cmdExitCode)
+	}
+	if scriptBuild != nil {
+		return scriptBuild.HoldLock()
+	}
+	return nil
 }
 
-func joinLines(script []string) []string {
-	for i, line := range script {
-		if strings.HasSuffix(line, `\`) && i != len(script)-1 {
-			line = strings.TrimSuffix(line, `\`)
-			script[i] = ""
-			script[i+1] = line + " " + script[i+1]
+// exitStatus is returned when a line of a script exits with a non-zero code.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// flagResetter is implemented by flag values that can't be reset by setting
+// their default value, such as lists that are appended to.
+type flagResetter interface {
+	reset()
+}
+
+// resetFlags returns every flag of cmd and its subcommands to its default
+// value, so that flags given on one line of a script don't carry over to the
+// next.
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if !f.Changed {
+			return
+		}
+		if r, ok := f.Value.(flagResetter); ok {
+			r.reset()
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, c := range cmd.Commands() {
+		resetFlags(c)
+	}
+}
+
+// splitLines splits a script into its non-empty lines, with surrounding
+// whitespace trimmed. A line ending with a backslash is joined to the line
+// after it.
+func splitLines(rawScript string) []scriptLine {
+	var lines []scriptLine
+	var current *scriptLine
+	physical := strings.Split(rawScript, "\n")
+	for i := 0; i < len(physical); i++ {
+		text := strings.TrimSpace(physical[i])
+		if current != nil {
+			current.text += " " + text
+		} else {
+			current = &scriptLine{num: i + 1, text: text}
+		}
+		if strings.HasSuffix(current.text, `\`) && i != len(physical)-1 {
+			current.text = strings.TrimSuffix(current.text, `\`)
+			continue
+		}
+		if current.text != "" {
+			if m := heredocRegexp.FindStringSubmatch(current.text); m != nil && !strings.HasPrefix(current.text, "#") {
+				current.text = strings.TrimSpace(strings.TrimSuffix(current.text, m[0]))
+				current.heredoc, i = readHeredoc(physical, i+1, m)
+			}
+			lines = append(lines, *current)
 		}
+		current = nil
 	}
-	return script
+	return lines
+}
+
+// readHeredoc reads the heredoc that starts at physical[start], described by
+// the match of heredocRegexp that began it. It returns the heredoc and the
+// index of its last line.
+func readHeredoc(physical []string, start int, m []string) (*heredoc, int) {
+	stripTabs := m[1] == "-"
+	h := &heredoc{delim: m[2] + m[3] + m[4], expand: m[4] != ""}
+	var body []string
+	i := start
+	for ; i < len(physical); i++ {
+		text := physical[i]
+		if stripTabs {
+			text = strings.TrimLeft(text, "\t")
+		}
+		if strings.TrimSpace(text) == h.delim {
+			h.terminated = true
+			break
+		}
+		body = append(body, text)
+	}
+	if !h.terminated && len(body) > 0 && body[len(body)-1] == "" {
+		// The newline at the end of the file.
+		body = body[:len(body)-1]
+	}
+	for _, line := range body {
+		h.text += line + "\n"
+	}
+	return h, i
 }
 
 func tokenizeLine(line string) ([]string, error) {
+	return tokenizeAndExpand(line, nil)
+}
+
+// tokenizeAndExpand splits line into tokens like tokenizeLine, and expands any
+// ${VAR} references outside of single quotes using vars. The value of a
+// variable is never split into several tokens.
+func tokenizeAndExpand(line string, vars *scriptVars) ([]string, error) {
 	var tokens []string
 	buf := &bytes.Buffer{}
 	inSingleQuoteBlock := false
 	inDoubleQuoteBlock := false
 	isEscaped := false
+	runes := []rune(line)
 lineLoop:
-	for _, char := range line {
+	for i := 0; i < len(runes); i++ {
+		char := runes[i]
 		if isEscaped {
 			buf.WriteRune(char)
 			isEscaped = false
@@ -194,6 +751,17 @@ lineLoop:
 			inSingleQuoteBlock = !inSingleQuoteBlock
 		case char == '"' && !inSingleQuoteBlock:
 			inDoubleQuoteBlock = !inDoubleQuoteBlock
+		case char == '$' && vars != nil && !inSingleQuoteBlock && i+1 < len(runes) && runes[i+1] == '{':
+			expr, end, err := varReference(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			val, err := vars.expand(expr)
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteString(val)
+			i = end
 		case char == '#' && !inSingleQuoteBlock && !inDoubleQuoteBlock:
 			if buf.Len() > 0 {
 				tokens = append(tokens, buf.String())
@@ -15,39 +15,54 @@
 package main
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/spf13/cobra"
 )
 
-func TestJoinLines(t *testing.T) {
+func TestSplitLines(t *testing.T) {
 	type testcase struct {
-		input  []string
-		output []string
+		input  string
+		output []scriptLine
 	}
 	cases := []testcase{
 		testcase{
-			[]string{"this is", "a test"},
-			[]string{"this is", "a test"},
+			"this is\na test",
+			[]scriptLine{{1, "this is", nil}, {2, "a test", nil}},
+		},
+		testcase{
+			"this is \\\na test",
+			[]scriptLine{{1, "this is  a test", nil}},
+		},
+		testcase{
+			"this is\\\n  another    \\\ntest\n\nlast",
+			[]scriptLine{{1, "this is another     test", nil}, {5, "last", nil}},
 		},
 		testcase{
-			[]string{`this is \`, `a test`},
-			[]string{"", "this is  a test"},
+			"this is a test \\",
+			[]scriptLine{{1, "this is a test \\", nil}},
 		},
 		testcase{
-			[]string{`this is\`, `another    \`, `test`},
-			[]string{"", "", "this is another     test"},
+			"\nthis\\\nis\\\na\ntest",
+			[]scriptLine{{2, "this is a", nil}, {5, "test", nil}},
 		},
 		testcase{
-			[]string{`this is a test \`},
-			[]string{`this is a test \`},
+			"write-file /a <<EOF\n  indented ${X}\nEOF\nwrite-file /b <<-'END'\n\tquoted ${X}\n\tEND\nlast",
+			[]scriptLine{
+				{1, "write-file /a", &heredoc{"EOF", "  indented ${X}\n", true, true}},
+				{4, "write-file /b", &heredoc{"END", "quoted ${X}\n", false, true}},
+				{7, "last", nil},
+			},
 		},
 		testcase{
-			[]string{`this\`, `is\`, `a`, `test`},
-			[]string{"", "", "this is a", "test"},
+			"write-file /a <<EOF\nnever ends\n",
+			[]scriptLine{{1, "write-file /a", &heredoc{"EOF", "never ends\n", true, false}}},
 		},
 	}
 	for _, c := range cases {
-		output := joinLines(c.input)
-		if !equal(output, c.output) {
+		output := splitLines(c.input)
+		if !reflect.DeepEqual(output, c.output) {
 			t.Errorf("output, expected:%v actual:%v", c.output, output)
 		}
 	}
@@ -298,3 +313,125 @@ func equal(s1 []string, s2 []string) bool {
 	}
 	return true
 }
+
+func TestTokenizeAndExpand(t *testing.T) {
+	vars := newScriptVars(map[string]string{"VERSION": "1.2"})
+	for _, decl := range []string{"VERSION", "CHANNEL=stable", "UNSET"} {
+		if err := vars.declareArg(decl); err != nil {
+			t.Fatalf("declaring %s: %v", decl, err)
+		}
+	}
+	if err := vars.set("EMPTY="); err != nil {
+		t.Fatal(err)
+	}
+
+	type testcase struct {
+		input  string
+		output []string
+		err    bool
+	}
+	cases := []testcase{
+		testcase{
+			"label add version ${VERSION}",
+			[]string{"label", "add", "version", "1.2"},
+			false,
+		},
+		testcase{
+			"set-name example.com/app-${CHANNEL}-${VERSION}",
+			[]string{"set-name", "example.com/app-stable-1.2"},
+			false,
+		},
+		// no expansion in single quotes, or when escaped
+		testcase{
+			`label add '${VERSION}' "${VERSION}" \${VERSION}`,
+			[]string{"label", "add", "${VERSION}", "1.2", "${VERSION}"},
+			false,
+		},
+		// defaults, used when the variable is undefined or empty
+		testcase{
+			"label add a ${UNSET:-x} ${EMPTY:-y} ${VERSION:-z} ${UNSET:-${CHANNEL}}",
+			[]string{"label", "add", "a", "x", "y", "1.2", "stable"},
+			false,
+		},
+		// values aren't split on whitespace
+		testcase{
+			"label add a ${UNSET:-b c}",
+			[]string{"label", "add", "a", "b c"},
+			false,
+		},
+		testcase{
+			"label add a ${UNSET}",
+			nil,
+			true,
+		},
+		testcase{
+			"label add a ${VERSION",
+			nil,
+			true,
+		},
+		testcase{
+			"label add a ${1NVALID}",
+			nil,
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		output, err := tokenizeAndExpand(c.input, vars)
+		if (err != nil) != c.err {
+			t.Errorf("%q: unexpected error: %v", c.input, err)
+		}
+		if !equal(output, c.output) {
+			t.Errorf("%q: output, expected:%v actual:%v", c.input, c.output, output)
+		}
+	}
+}
+
+func TestScriptVarsUnusedArgs(t *testing.T) {
+	vars := newScriptVars(map[string]string{"A": "1", "B": "2"})
+	if err := vars.declareArg("A=0"); err != nil {
+		t.Fatal(err)
+	}
+	if unused := vars.unusedArgs(); !equal(unused, []string{"B"}) {
+		t.Errorf("unexpected unused args: %v", unused)
+	}
+	if vars.vars["A"] != "1" {
+		t.Errorf("build argument didn't override the default, A=%q", vars.vars["A"])
+	}
+}
+
+func TestCommandArgCount(t *testing.T) {
+	cases := map[*cobra.Command]argCount{
+		cmdCopy:      {2, 2},
+		cmdCopyToDir: {2, -1},
+		cmdBegin:     {0, 1},
+		cmdRun:       {1, -1},
+		cmdEnd:       {0, 0},
+		cmdAddPort:   {3, 3},
+	}
+	for cmd, wanted := range cases {
+		if got := commandArgCount(cmd); got != wanted {
+			t.Errorf("%s: got %v, wanted %v", cmd.Name(), got, wanted)
+		}
+	}
+}
+
+func TestCheckScript(t *testing.T) {
+	script := `ARG NAME
+begin --build-mode oci
+set-name example.com/${NAME}
+copy onlyone
+STAGE runtime
+begin
+label add version 1
+write out.aci
+`
+	problems := checkScript("build.acb", []byte(script), map[string]string{"NAME": "app"})
+	wanted := []string{
+		"build.acb:3: set-name: only supported in appc builds",
+		"build.acb:4: copy: expected 2 arguments, got 1",
+	}
+	if !equal(problems, wanted) {
+		t.Errorf("problems, expected:%v actual:%v", wanted, problems)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	writeFileContent string
+	writeFileMode    string
+	writeFileOwner   string
+	cmdWriteFile     = &cobra.Command{
+		Use:     "write-file PATH_IN_ACI",
+		Short:   "Write a file in the image with the given contents",
+		Example: "acbuild write-file --content 'nameserver 8.8.8.8' /etc/resolv.conf\n  acbuild write-file --mode 0600 /etc/app/secret.conf < secret.conf",
+		Run:     runWrapper(runWriteFile),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdWriteFile)
+
+	cmdWriteFile.Flags().StringVar(&writeFileContent, "content", "", "The contents of the file (default is to read them from stdin)")
+	cmdWriteFile.Flags().StringVar(&writeFileMode, "mode", "0644", "The permissions of the file, in octal")
+	cmdWriteFile.Flags().StringVar(&writeFileOwner, "owner", "", "The owner of the file, as UID[:GID]")
+}
+
+func runWriteFile(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return 1
+	}
+	if len(args) != 1 {
+		stderr("write-file: incorrect number of arguments")
+		return 1
+	}
+
+	perm, err := strconv.ParseUint(writeFileMode, 8, 32)
+	if err != nil || perm&^uint64(os.ModePerm) != 0 {
+		stderr("write-file: invalid mode %q", writeFileMode)
+		return 1
+	}
+	uid, gid, err := parseOwner(writeFileOwner)
+	if err != nil {
+		stderr("write-file: %v", err)
+		return 1
+	}
+
+	contents := []byte(writeFileContent)
+	if !cmd.Flags().Changed("content") {
+		contents, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			stderr("write-file: %v", err)
+			return 1
+		}
+	}
+
+	if debug {
+		stderr("Writing %d bytes to aci:%s", len(contents), args[0])
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	err = a.WriteFile(args[0], contents, os.FileMode(perm), uid, gid)
+	if err != nil {
+		stderr("write-file: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
+
+// parseOwner parses an owner of the form UID[:GID]. Whatever isn't given is
+// returned as -1.
+func parseOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+	parts := strings.SplitN(owner, ":", 2)
+	ids := []int{-1, -1}
+	for i, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return 0, 0, fmt.Errorf("invalid owner %q, expected UID[:GID]", owner)
+		}
+		ids[i] = id
+	}
+	return ids[0], ids[1], nil
+}
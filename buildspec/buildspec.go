@@ -0,0 +1,243 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package buildspec parses declarative build specifications, which describe an
+// image and the steps to build it in YAML or JSON.
+package buildspec
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ModeAppC = "appc"
+	ModeOCI  = "oci"
+)
+
+// Spec describes an image build. The fields mirror the acbuild subcommands
+// that they're applied with.
+type Spec struct {
+	// Mode is the build mode, "appc" or "oci". The default is "appc".
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Base is the image the build begins from, as accepted by begin. An
+	// empty base begins an empty image.
+	Base string `json:"base,omitempty" yaml:"base,omitempty"`
+	// Insecure allows fetching the base image over an unencrypted connection.
+	Insecure bool `json:"insecure,omitempty" yaml:"insecure,omitempty"`
+
+	Name             string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations      map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Environment      map[string]string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	Ports            []Port            `json:"ports,omitempty" yaml:"ports,omitempty"`
+	Mounts           []Mount           `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+	Isolators        []Isolator        `json:"isolators,omitempty" yaml:"isolators,omitempty"`
+	User             string            `json:"user,omitempty" yaml:"user,omitempty"`
+	Group            string            `json:"group,omitempty" yaml:"group,omitempty"`
+	WorkingDirectory string            `json:"workingDirectory,omitempty" yaml:"workingDirectory,omitempty"`
+	Exec             []string          `json:"exec,omitempty" yaml:"exec,omitempty"`
+
+	// Steps are run in order, after the image's metadata has been set.
+	Steps []Step `json:"steps,omitempty" yaml:"steps,omitempty"`
+
+	// Outputs are the paths the finished image is written to.
+	Outputs []string `json:"outputs" yaml:"outputs"`
+}
+
+type Port struct {
+	Name            string `json:"name" yaml:"name"`
+	Protocol        string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+	Port            uint   `json:"port" yaml:"port"`
+	Count           uint   `json:"count,omitempty" yaml:"count,omitempty"`
+	SocketActivated bool   `json:"socketActivated,omitempty" yaml:"socketActivated,omitempty"`
+}
+
+type Mount struct {
+	Name     string `json:"name" yaml:"name"`
+	Path     string `json:"path" yaml:"path"`
+	ReadOnly bool   `json:"readOnly,omitempty" yaml:"readOnly,omitempty"`
+}
+
+// Isolator is an appc isolator. Value is its JSON value, which can be written
+// as YAML.
+type Isolator struct {
+	Name  string      `json:"name" yaml:"name"`
+	Value interface{} `json:"value" yaml:"value"`
+}
+
+// Step is a single build step. Exactly one of Run, Copy and CopyToDir is set.
+type Step struct {
+	// Run is a command to run in the image, as with the run subcommand.
+	Run []string `json:"run,omitempty" yaml:"run,omitempty"`
+	// WorkingDirectory is where Run is run, inside the image.
+	WorkingDirectory string `json:"workingDirectory,omitempty" yaml:"workingDirectory,omitempty"`
+
+	Copy      *Copy      `json:"copy,omitempty" yaml:"copy,omitempty"`
+	CopyToDir *CopyToDir `json:"copyToDir,omitempty" yaml:"copyToDir,omitempty"`
+}
+
+// Copy copies a file or directory on the host to a path in the image.
+type Copy struct {
+	From    string   `json:"from" yaml:"from"`
+	To      string   `json:"to" yaml:"to"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude"`
+}
+
+// CopyToDir copies files or directories on the host into a directory in the
+// image.
+type CopyToDir struct {
+	From    []string `json:"from" yaml:"from"`
+	To      string   `json:"to" yaml:"to"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude"`
+}
+
+// Parse parses a spec written in YAML or JSON. Unknown fields are an error.
+func Parse(data []byte) (*Spec, error) {
+	s := &Spec{}
+	err := yaml.UnmarshalStrict(data, s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Mode == "" {
+		s.Mode = ModeAppC
+	}
+	return s, nil
+}
+
+// Validate returns every problem with the spec that would stop it from being
+// built.
+func (s *Spec) Validate() []string {
+	var problems []string
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	switch s.Mode {
+	case ModeAppC:
+		if s.Name == "" {
+			report("name: required in appc builds")
+		}
+	case ModeOCI:
+		if s.Name != "" {
+			report("name: only supported in appc builds")
+		}
+		if len(s.Isolators) != 0 {
+			report("isolators: only supported in appc builds")
+		}
+	default:
+		report("mode: invalid build mode %q", s.Mode)
+	}
+
+	for i, p := range s.Ports {
+		if p.Name == "" {
+			report("ports[%d]: name is required", i)
+		}
+		if p.Port == 0 {
+			report("ports[%d]: port is required", i)
+		}
+	}
+	for i, m := range s.Mounts {
+		if m.Name == "" {
+			report("mounts[%d]: name is required", i)
+		}
+		if m.Path == "" {
+			report("mounts[%d]: path is required", i)
+		}
+	}
+	for i, iso := range s.Isolators {
+		if iso.Name == "" {
+			report("isolators[%d]: name is required", i)
+		}
+		if _, err := iso.ValueJSON(); err != nil {
+			report("isolators[%d]: %v", i, err)
+		}
+	}
+
+	for i, step := range s.Steps {
+		set := 0
+		if step.Run != nil {
+			set++
+			if len(step.Run) == 0 {
+				report("steps[%d]: run: no command given", i)
+			}
+		}
+		if step.WorkingDirectory != "" && step.Run == nil {
+			report("steps[%d]: workingDirectory is only used by run", i)
+		}
+		if step.Copy != nil {
+			set++
+			if step.Copy.From == "" || step.Copy.To == "" {
+				report("steps[%d]: copy: from and to are required", i)
+			}
+		}
+		if step.CopyToDir != nil {
+			set++
+			if len(step.CopyToDir.From) == 0 || step.CopyToDir.To == "" {
+				report("steps[%d]: copyToDir: from and to are required", i)
+			}
+		}
+		if set != 1 {
+			report("steps[%d]: expected exactly one of run, copy and copyToDir", i)
+		}
+	}
+
+	if len(s.Outputs) == 0 {
+		report("outputs: at least one output is required")
+	}
+	return problems
+}
+
+// ValueJSON returns the isolator's value encoded as JSON.
+func (iso Isolator) ValueJSON() ([]byte, error) {
+	val, err := jsonValue(iso.Value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(val)
+}
+
+// jsonValue converts the maps decoded from YAML, which can have keys of any
+// type, to maps that can be encoded as JSON.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid key %v, keys must be strings", key)
+			}
+			val, err := jsonValue(val)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = val
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, val := range v {
+			val, err := jsonValue(val)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = val
+		}
+		return l, nil
+	}
+	return v, nil
+}
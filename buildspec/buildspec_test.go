@@ -0,0 +1,127 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buildspec
+
+import (
+	"reflect"
+	"testing"
+)
+
+const yamlSpec = `
+name: example.com/app
+labels:
+  version: "1.0"
+ports:
+  - name: http
+    port: 80
+isolators:
+  - name: resource/cpu
+    value:
+      request: 250m
+      limit: 500m
+steps:
+  - copy: {from: app, to: /usr/bin/app}
+  - run: [/usr/bin/app, --init]
+    workingDirectory: /var/lib/app
+outputs: [app.aci]
+`
+
+const jsonSpec = `{
+	"mode": "oci",
+	"environment": {"PATH": "/bin"},
+	"steps": [{"copyToDir": {"from": ["a", "b"], "to": "/opt"}}],
+	"outputs": ["app.oci"]
+}`
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(yamlSpec))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	wanted := &Spec{
+		Mode:   ModeAppC,
+		Name:   "example.com/app",
+		Labels: map[string]string{"version": "1.0"},
+		Ports:  []Port{{Name: "http", Port: 80}},
+		Isolators: []Isolator{{
+			Name: "resource/cpu",
+			Value: map[interface{}]interface{}{
+				"request": "250m",
+				"limit":   "500m",
+			},
+		}},
+		Steps: []Step{
+			{Copy: &Copy{From: "app", To: "/usr/bin/app"}},
+			{Run: []string{"/usr/bin/app", "--init"}, WorkingDirectory: "/var/lib/app"},
+		},
+		Outputs: []string{"app.aci"},
+	}
+	if !reflect.DeepEqual(s, wanted) {
+		t.Errorf("parsed %#v, wanted %#v", s, wanted)
+	}
+	val, err := s.Isolators[0].ValueJSON()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(val) != `{"limit":"500m","request":"250m"}` {
+		t.Errorf("isolator value is %s", val)
+	}
+	if problems := s.Validate(); len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	s, err = Parse([]byte(jsonSpec))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Mode != ModeOCI || s.Environment["PATH"] != "/bin" || s.Steps[0].CopyToDir.To != "/opt" {
+		t.Errorf("unexpected spec parsed from JSON: %#v", s)
+	}
+	if problems := s.Validate(); len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	if _, err := Parse([]byte("nmae: example.com/app\n")); err == nil {
+		t.Errorf("no error for an unknown field")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := &Spec{
+		Mode:      ModeOCI,
+		Name:      "example.com/app",
+		Isolators: []Isolator{{Name: "resource/cpu"}},
+		Ports:     []Port{{Name: "http"}},
+		Steps: []Step{
+			{},
+			{Run: []string{"make"}, Copy: &Copy{From: "a", To: "/a"}},
+			{Copy: &Copy{From: "a"}, WorkingDirectory: "/src"},
+		},
+	}
+	wanted := []string{
+		"name: only supported in appc builds",
+		"isolators: only supported in appc builds",
+		"ports[0]: port is required",
+		"steps[0]: expected exactly one of run, copy and copyToDir",
+		"steps[1]: expected exactly one of run, copy and copyToDir",
+		"steps[2]: workingDirectory is only used by run",
+		"steps[2]: copy: from and to are required",
+		"outputs: at least one output is required",
+	}
+	problems := s.Validate()
+	if !reflect.DeepEqual(problems, wanted) {
+		t.Errorf("got problems:\n%v\nwanted:\n%v", problems, wanted)
+	}
+}
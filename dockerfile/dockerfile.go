@@ -0,0 +1,358 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dockerfile parses Dockerfiles into a list of instructions, and
+// implements the word splitting and variable expansion Docker applies to their
+// arguments.
+package dockerfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const defaultEscape = '\\'
+
+var escapeDirectiveRegexp = regexp.MustCompile(`^#\s*escape\s*=\s*(.)\s*$`)
+
+// Instruction is a single instruction from a Dockerfile.
+type Instruction struct {
+	// Command is the instruction's name in upper case, such as "RUN".
+	Command string
+
+	// Flags holds any --name=value flags given before the arguments, as
+	// accepted by COPY and ADD.
+	Flags map[string]string
+
+	// Args is the rest of the instruction, with line continuations joined.
+	Args string
+
+	// JSON is set if the arguments were given as a JSON array, in which case
+	// JSONArgs holds its elements.
+	JSON     bool
+	JSONArgs []string
+
+	// Line is the line of the Dockerfile the instruction starts on.
+	Line int
+}
+
+// Dockerfile is a parsed Dockerfile.
+type Dockerfile struct {
+	Instructions []Instruction
+
+	// Escape is the escape character, which can be changed with an escape
+	// parser directive.
+	Escape rune
+}
+
+// Parse reads a Dockerfile from r.
+func Parse(r io.Reader) (*Dockerfile, error) {
+	d := &Dockerfile{Escape: defaultEscape}
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	directives := true
+
+	var current string
+	startLine := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimLeftFunc(scanner.Text(), unicode.IsSpace)
+
+		if directives {
+			if m := escapeDirectiveRegexp.FindStringSubmatch(line); m != nil {
+				if m[1] != "\\" && m[1] != "`" {
+					return nil, fmt.Errorf("line %d: invalid escape character %q", lineNum, m[1])
+				}
+				d.Escape = rune(m[1][0])
+				continue
+			}
+			directives = false
+		}
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if current == "" {
+			if line == "" {
+				continue
+			}
+			startLine = lineNum
+		}
+
+		trimmed := strings.TrimRightFunc(line, unicode.IsSpace)
+		if strings.HasSuffix(trimmed, string(d.Escape)) {
+			current += strings.TrimSuffix(trimmed, string(d.Escape))
+			continue
+		}
+		current += line
+
+		inst, err := parseInstruction(current, startLine)
+		if err != nil {
+			return nil, err
+		}
+		d.Instructions = append(d.Instructions, *inst)
+		current = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != "" {
+		inst, err := parseInstruction(current, startLine)
+		if err != nil {
+			return nil, err
+		}
+		d.Instructions = append(d.Instructions, *inst)
+	}
+	return d, nil
+}
+
+func parseInstruction(line string, lineNum int) (*Instruction, error) {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if i := strings.IndexFunc(parts[0], unicode.IsSpace); i != -1 {
+		parts = []string{parts[0][:i], parts[0][i:]}
+	}
+	inst := &Instruction{
+		Command: strings.ToUpper(parts[0]),
+		Line:    lineNum,
+	}
+	if len(parts) == 2 {
+		inst.Args = strings.TrimSpace(parts[1])
+	}
+
+	switch inst.Command {
+	case "COPY", "ADD", "FROM", "RUN":
+		inst.Flags, inst.Args = parseFlags(inst.Args)
+	}
+
+	if strings.HasPrefix(inst.Args, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(inst.Args), &args); err == nil {
+			inst.JSON = true
+			inst.JSONArgs = args
+		}
+	}
+	return inst, nil
+}
+
+// parseFlags splits the leading --name=value flags off of args.
+func parseFlags(args string) (map[string]string, string) {
+	flags := make(map[string]string)
+	for strings.HasPrefix(args, "--") {
+		end := strings.IndexFunc(args, unicode.IsSpace)
+		if end == -1 {
+			end = len(args)
+		}
+		flag := args[2:end]
+		parts := strings.SplitN(flag, "=", 2)
+		if len(parts) == 2 {
+			flags[parts[0]] = parts[1]
+		} else {
+			flags[parts[0]] = ""
+		}
+		args = strings.TrimSpace(args[end:])
+	}
+	return flags, args
+}
+
+// Lookup returns the value of a variable, and whether it's defined.
+type Lookup func(name string) (string, bool)
+
+// Words splits s into words on whitespace the way Docker does for
+// instructions like COPY and ENV. Quotes are removed, and if lookup isn't nil
+// variable references outside of single quotes are expanded. Undefined
+// variables expand to nothing.
+func Words(s string, escape rune, lookup Lookup) ([]string, error) {
+	return process(s, escape, lookup, true)
+}
+
+// Word expands the variable references in s like Words, without splitting it.
+func Word(s string, escape rune, lookup Lookup) (string, error) {
+	words, err := process(s, escape, lookup, false)
+	if err != nil || len(words) == 0 {
+		return "", err
+	}
+	return words[0], nil
+}
+
+func process(s string, escape rune, lookup Lookup, split bool) ([]string, error) {
+	var words []string
+	buf := &bytes.Buffer{}
+	inWord := false
+	inSingle, inDouble := false, false
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		char := runes[i]
+		switch {
+		case char == escape && !inSingle && i+1 < len(runes):
+			i++
+			if inDouble && runes[i] != '"' && runes[i] != '$' && runes[i] != escape {
+				buf.WriteRune(char)
+			}
+			buf.WriteRune(runes[i])
+			inWord = true
+		case char == '\'' && !inDouble:
+			inSingle = !inSingle
+			inWord = true
+		case char == '"' && !inSingle:
+			inDouble = !inDouble
+			inWord = true
+		case char == '$' && !inSingle && lookup != nil:
+			val, end, err := expand(runes, i, escape, lookup)
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteString(val)
+			i = end
+			inWord = true
+		case split && unicode.IsSpace(char) && !inSingle && !inDouble:
+			if inWord {
+				words = append(words, buf.String())
+				buf.Reset()
+				inWord = false
+			}
+		default:
+			buf.WriteRune(char)
+			inWord = true
+		}
+	}
+	if inSingle || inDouble {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord || !split {
+		words = append(words, buf.String())
+	}
+	return words, nil
+}
+
+// expand expands the variable reference starting with the $ at runes[start],
+// and returns its value and the index of its last character.
+func expand(runes []rune, start int, escape rune, lookup Lookup) (string, int, error) {
+	i := start + 1
+	if i == len(runes) {
+		return "$", start, nil
+	}
+	if runes[i] != '{' {
+		end := i
+		for end < len(runes) && (runes[end] == '_' || unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end])) {
+			end++
+		}
+		if end == i {
+			return "$", start, nil
+		}
+		val, _ := lookup(string(runes[i:end]))
+		return val, end - 1, nil
+	}
+
+	depth := 0
+	for end := i; end < len(runes); end++ {
+		switch runes[end] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			expr := string(runes[i+1 : end])
+			val, err := expandExpr(expr, escape, lookup)
+			return val, end, err
+		}
+	}
+	return "", 0, fmt.Errorf("missing '}' in %q", string(runes[start:]))
+}
+
+// expandExpr expands NAME, NAME:-word or NAME:+word.
+func expandExpr(expr string, escape rune, lookup Lookup) (string, error) {
+	i := strings.Index(expr, ":")
+	if i == -1 {
+		val, _ := lookup(expr)
+		return val, nil
+	}
+	name, modifier, word := expr[:i], expr[i:], ""
+	if len(modifier) >= 2 {
+		modifier, word = modifier[:2], modifier[2:]
+	}
+	val, _ := lookup(name)
+	switch modifier {
+	case ":-":
+		if val != "" {
+			return val, nil
+		}
+		return Word(word, escape, lookup)
+	case ":+":
+		if val == "" {
+			return "", nil
+		}
+		return Word(word, escape, lookup)
+	}
+	return "", fmt.Errorf("unsupported modifier in ${%s}", expr)
+}
+
+// KeyValues parses the arguments of ENV, LABEL or ARG, which are either a
+// single "key value" pair, or any number of key=value pairs. Keys without a
+// value, which ARG accepts, are returned with hasValue set to false.
+func KeyValues(args string, escape rune, lookup Lookup) ([]KeyValue, error) {
+	words, err := Words(args, escape, lookup)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("missing arguments")
+	}
+	if !strings.Contains(words[0], "=") && len(words) > 1 {
+		// The old "ENV key value" form, where the value is the rest of the
+		// line.
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args), firstField(args)))
+		val, err := Word(rest, escape, lookup)
+		if err != nil {
+			return nil, err
+		}
+		return []KeyValue{{Key: words[0], Value: val, HasValue: true}}, nil
+	}
+	var kvs []KeyValue
+	for _, w := range words {
+		parts := strings.SplitN(w, "=", 2)
+		kv := KeyValue{Key: parts[0]}
+		if len(parts) == 2 {
+			kv.Value, kv.HasValue = parts[1], true
+		}
+		if kv.Key == "" {
+			return nil, fmt.Errorf("missing key in %q", w)
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs, nil
+}
+
+// KeyValue is a pair parsed by KeyValues.
+type KeyValue struct {
+	Key      string
+	Value    string
+	HasValue bool
+}
+
+func firstField(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
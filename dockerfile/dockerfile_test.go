@@ -0,0 +1,126 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	d, err := Parse(strings.NewReader(`# escape=` + "`" + `
+# A comment
+FROM busybox
+
+run echo one ` + "`" + `
+    # a comment in the middle
+    two
+COPY --chown=1:1 a b /dst/
+CMD ["/bin/app", "--flag"]
+`))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d.Escape != '`' {
+		t.Errorf("escape is %q, wanted '`'", d.Escape)
+	}
+
+	wanted := []Instruction{
+		{Command: "FROM", Flags: map[string]string{}, Args: "busybox", Line: 3},
+		{Command: "RUN", Flags: map[string]string{}, Args: "echo one two", Line: 5},
+		{Command: "COPY", Flags: map[string]string{"chown": "1:1"}, Args: "a b /dst/", Line: 8},
+		{Command: "CMD", Args: `["/bin/app", "--flag"]`, JSON: true, JSONArgs: []string{"/bin/app", "--flag"}, Line: 9},
+	}
+	if !reflect.DeepEqual(d.Instructions, wanted) {
+		t.Errorf("parsed\n%#v\nwanted\n%#v", d.Instructions, wanted)
+	}
+}
+
+func TestParseInvalidEscape(t *testing.T) {
+	_, err := Parse(strings.NewReader("# escape=x\nFROM scratch\n"))
+	if err == nil {
+		t.Errorf("invalid escape character was accepted")
+	}
+}
+
+func TestWords(t *testing.T) {
+	vars := map[string]string{
+		"NAME":  "world",
+		"EMPTY": "",
+		"SPACE": "a b",
+	}
+	lookup := func(name string) (string, bool) {
+		val, ok := vars[name]
+		return val, ok
+	}
+
+	type testcase struct {
+		input  string
+		output []string
+	}
+	cases := []testcase{
+		{`hello $NAME`, []string{"hello", "world"}},
+		{`hello ${NAME}s`, []string{"hello", "worlds"}},
+		{`'$NAME' "$NAME"`, []string{"$NAME", "world"}},
+		{`\$NAME`, []string{"$NAME"}},
+		{`${UNDEFINED}x`, []string{"x"}},
+		{`${EMPTY:-default} ${NAME:-default}`, []string{"default", "world"}},
+		{`${NAME:+set} ${EMPTY:+set}x`, []string{"set", "x"}},
+		{`$SPACE`, []string{"a b"}},
+		{`"a \"quoted\" word"`, []string{`a "quoted" word`}},
+		{`cost $5`, []string{"cost", ""}},
+		{`100$`, []string{"100$"}},
+	}
+	for _, c := range cases {
+		output, err := Words(c.input, defaultEscape, lookup)
+		if err != nil {
+			t.Errorf("%s: %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(output, c.output) {
+			t.Errorf("%s: got %q, wanted %q", c.input, output, c.output)
+		}
+	}
+
+	for _, input := range []string{`"unterminated`, `${NAME`, `${NAME:?x}`} {
+		if _, err := Words(input, defaultEscape, lookup); err == nil {
+			t.Errorf("%s: no error", input)
+		}
+	}
+}
+
+func TestKeyValues(t *testing.T) {
+	type testcase struct {
+		input  string
+		output []KeyValue
+	}
+	cases := []testcase{
+		{`KEY value with spaces`, []KeyValue{{"KEY", "value with spaces", true}}},
+		{`A=1 B="two words"`, []KeyValue{{"A", "1", true}, {"B", "two words", true}}},
+		{`NAME`, []KeyValue{{"NAME", "", false}}},
+		{`NAME=`, []KeyValue{{"NAME", "", true}}},
+	}
+	for _, c := range cases {
+		output, err := KeyValues(c.input, defaultEscape, nil)
+		if err != nil {
+			t.Errorf("%s: %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(output, c.output) {
+			t.Errorf("%s: got %v, wanted %v", c.input, output, c.output)
+		}
+	}
+}
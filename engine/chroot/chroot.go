@@ -15,9 +15,12 @@
 package chroot
 
 import (
+	"bytes"
+	"encoding/csv"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/containers/build/engine"
 	"github.com/rkt/rkt/pkg/fileutil"
@@ -47,19 +50,17 @@ func (e Engine) Run(command string, args []string, environment map[string]string
 	case err != nil:
 		return err
 	}
-	var serializedArgs string
-	for _, arg := range args {
-		if serializedArgs != "" {
-			serializedArgs += ","
-		}
-		serializedArgs += arg
-	}
-	var serializedEnv string
+	var env []string
 	for name, value := range environment {
-		if serializedEnv != "" {
-			serializedEnv += ","
-		}
-		serializedEnv += name + "=" + value
+		env = append(env, name+"="+value)
+	}
+	serializedArgs, err := serializeList(args)
+	if err != nil {
+		return err
+	}
+	serializedEnv, err := serializeList(env)
+	if err != nil {
+		return err
 	}
 	path := "PATH="
 	for _, p := range engine.Pathlist {
@@ -86,3 +87,22 @@ func (e Engine) Run(command string, args []string, environment map[string]string
 	cmd.Env = []string{path}
 	return cmd.Run()
 }
+
+// serializeList encodes list as a single CSV record, which is how the string
+// slice flags of acbuild-chroot are parsed.
+func serializeList(list []string) (string, error) {
+	if len(list) == 0 {
+		return "", nil
+	}
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	err := w.Write(list)
+	if err != nil {
+		return "", err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -15,6 +15,8 @@
 package appc
 
 import (
+	"fmt"
+
 	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
 )
@@ -49,6 +51,24 @@ func (m *Manifest) RemoveDependency(imageName string) error {
 	return m.save()
 }
 
+// PinDependencies sets the image ID and size of each of the manifest's
+// dependencies to those of the corresponding entry in pins. pins must list
+// the same dependencies as the manifest, in the same order.
+func (m *Manifest) PinDependencies(pins types.Dependencies) error {
+	if len(pins) != len(m.manifest.Dependencies) {
+		return fmt.Errorf("expected %d dependencies to pin, got %d", len(m.manifest.Dependencies), len(pins))
+	}
+	for i, pin := range pins {
+		dep := &m.manifest.Dependencies[i]
+		if dep.ImageName != pin.ImageName {
+			return fmt.Errorf("dependency %d is %s, not %s", i, dep.ImageName, pin.ImageName)
+		}
+		dep.ImageID = pin.ImageID
+		dep.Size = pin.Size
+	}
+	return m.save()
+}
+
 func removeDep(imageName types.ACIdentifier, s *schema.ImageManifest) error {
 	foundOne := false
 	for i := len(s.Dependencies) - 1; i >= 0; i-- {
@@ -0,0 +1,435 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/aci"
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/rkt/rkt/pkg/fileutil"
+
+	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/util"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const dockerImagePrefix = "docker://"
+
+// AddBaseImage adds a base image on top of any existing ones in an OCI build.
+// ref is either the path of a local OCI image layout, as a directory or a tar,
+// or a docker:// reference to an image in a registry. The layers of the base
+// images are placed under the build's own layers when run is called, and are
+// flattened into the image when it is written.
+func (a *ACBuild) AddBaseImage(ref string) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	m, ok := a.man.(*oci.Image)
+	if !ok {
+		return fmt.Errorf("base images only supported in OCI builds")
+	}
+	ref, err = normalizeBaseImage(ref)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(ref, dockerImagePrefix) {
+		finfo, err := os.Stat(ref)
+		if err != nil {
+			return err
+		}
+		if finfo.IsDir() {
+			_, err = oci.LoadImage(ref)
+			if err != nil {
+				return fmt.Errorf("%s is not an OCI image layout: %v", ref, err)
+			}
+		}
+	}
+	return m.AddBaseImage(ref)
+}
+
+// RemoveBaseImage removes a base image from an OCI build.
+func (a *ACBuild) RemoveBaseImage(ref string) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	m, ok := a.man.(*oci.Image)
+	if !ok {
+		return fmt.Errorf("base images only supported in OCI builds")
+	}
+	ref, err = normalizeBaseImage(ref)
+	if err != nil {
+		return err
+	}
+	return m.RemoveBaseImage(ref)
+}
+
+// normalizeBaseImage makes local paths absolute, so that the same base image is
+// found no matter which directory acbuild is run from.
+func normalizeBaseImage(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, dockerImagePrefix):
+		return ref, nil
+	case strings.HasPrefix(ref, ".") || strings.HasPrefix(ref, "/"):
+		return filepath.Abs(ref)
+	}
+	return "", fmt.Errorf("base image must be a path to a local OCI image layout starting with '/' or '.', or a docker:// reference")
+}
+
+// baseImageLayers returns the layers of every base image of the build from the
+// bottom up, along with the layout each one is stored in.
+func (a *ACBuild) baseImageLayers(insecure bool) ([]baseLayer, error) {
+	m, ok := a.man.(*oci.Image)
+	if !ok {
+		return nil, fmt.Errorf("internal error: mismatched manifest type and build mode")
+	}
+	refs, err := m.GetBaseImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []baseLayer
+	for _, ref := range refs {
+		layoutPath, err := a.baseImageLayout(ref, insecure)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching base image %s: %v", ref, err)
+		}
+		img, err := oci.LoadImage(layoutPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading base image %s: %v", ref, err)
+		}
+		diffIDs := img.GetDiffIDs()
+		descriptors := img.GetManifest().Layers
+		if len(diffIDs) != len(descriptors) {
+			return nil, fmt.Errorf("base image %s has %d layers but %d diff IDs", ref, len(descriptors), len(diffIDs))
+		}
+		for i, desc := range descriptors {
+			layers = append(layers, baseLayer{
+				layoutPath: layoutPath,
+				descriptor: desc,
+				diffID:     diffIDs[i],
+			})
+		}
+	}
+	return layers, nil
+}
+
+type baseLayer struct {
+	layoutPath string
+	descriptor ociImage.Descriptor
+	diffID     string
+}
+
+func (l baseLayer) blobPath() (string, error) {
+	algo, hash, err := util.SplitOCILayerID(l.descriptor.Digest)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(l.layoutPath, "blobs", algo, hash), nil
+}
+
+// generateOverlayPathsBaseImages expands the layers of the build's base images,
+// and returns the paths they were expanded to from the bottom up.
+func (a *ACBuild) generateOverlayPathsBaseImages(insecure bool) ([]string, error) {
+	layers, err := a.baseImageLayers(insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, l := range layers {
+		err = util.OCIExtractLayers([]string{l.descriptor.Digest}, l.layoutPath, a.OCIExpandedBlobsPath)
+		if err != nil {
+			return nil, err
+		}
+		algo, hash, err := util.SplitOCILayerID(l.descriptor.Digest)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path.Join(a.OCIExpandedBlobsPath, algo, hash))
+	}
+	return paths, nil
+}
+
+// baseImageLayout returns the path of an OCI image layout holding the given
+// base image. Base images that aren't already a layout on disk are fetched or
+// extracted into the dependency store the first time they're needed.
+func (a *ACBuild) baseImageLayout(ref string, insecure bool) (string, error) {
+	key := ref
+	if !strings.HasPrefix(ref, dockerImagePrefix) {
+		finfo, err := os.Stat(ref)
+		if err != nil {
+			return "", err
+		}
+		if finfo.IsDir() {
+			return ref, nil
+		}
+		// A tar that changes should be extracted again.
+		key = fmt.Sprintf("%s:%d:%d", ref, finfo.Size(), finfo.ModTime().UnixNano())
+	}
+
+	storePath := path.Join(a.DepStoreExpandedPath, fmt.Sprintf("oci-%x", sha256.Sum256([]byte(key))))
+	_, err := os.Stat(storePath)
+	if err == nil {
+		return storePath, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	err = os.MkdirAll(a.DepStoreExpandedPath, 0755)
+	if err != nil {
+		return "", err
+	}
+	tmpPath, err := ioutil.TempDir(a.DepStoreExpandedPath, "oci-partial-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	if strings.HasPrefix(ref, dockerImagePrefix) {
+		err = writeDockerBaseImage(strings.TrimPrefix(ref, dockerImagePrefix), insecure, tmpPath)
+	} else {
+		err = util.ExtractImage(ref, tmpPath, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmpPath, storePath)
+	if err != nil {
+		return "", err
+	}
+	return storePath, nil
+}
+
+// writeDockerBaseImage fetches an image from a docker registry, and writes it
+// into an OCI image layout at layoutPath with its filesystem squashed into a
+// single layer.
+func writeDockerBaseImage(image string, insecure bool, layoutPath string) error {
+	outputDir, err := ioutil.TempDir("", "acbuild")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outputDir)
+
+	tempDir, err := ioutil.TempDir("", "acbuild")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	renderedACI, err := convertDockerImage(image, insecure, outputDir, tempDir)
+	if err != nil {
+		return err
+	}
+
+	aciPath := path.Join(tempDir, "expanded")
+	err = util.ExtractImage(renderedACI, aciPath, nil)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Join(layoutPath, "blobs", "sha256"), 0755)
+	if err != nil {
+		return err
+	}
+	tmpName, layerDigest, diffId, size, err := writeOCILayer(path.Join(aciPath, aci.RootfsDir), tempDir, nil)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, path.Join(layoutPath, "blobs", "sha256", layerDigest))
+	if err != nil {
+		return err
+	}
+
+	config := ociImage.Image{
+		Created:      time.Now().Format(time.RFC3339),
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS: ociImage.RootFS{
+			Type:    "layers",
+			DiffIDs: []string{"sha256:" + diffId},
+		},
+	}
+	manifest := ociImage.Manifest{
+		Layers: []ociImage.Descriptor{
+			{
+				MediaType: ociImage.MediaTypeImageLayer,
+				Digest:    "sha256:" + layerDigest,
+				Size:      size,
+			},
+		},
+	}
+	return writeOCILayout(layoutPath, "latest", config, manifest)
+}
+
+// flattenBaseImages stages a copy of the OCI image being built with the layers
+// of its base images placed under its own, and returns the path of the copy.
+// If the build has no base images, the path of the image itself is returned.
+func (a *ACBuild) flattenBaseImages() (string, error) {
+	m, ok := a.man.(*oci.Image)
+	if !ok {
+		return "", fmt.Errorf("internal error: mismatched manifest type and build mode")
+	}
+	refs, err := m.GetBaseImages()
+	if err != nil {
+		return "", err
+	}
+	if len(refs) == 0 {
+		return a.CurrentImagePath, nil
+	}
+
+	layers, err := a.baseImageLayers(false)
+	if err != nil {
+		return "", err
+	}
+
+	stagePath, err := ioutil.TempDir(a.ContextPath, "flattened-")
+	if err != nil {
+		return "", err
+	}
+	success := false
+	defer func() {
+		if !success {
+			os.RemoveAll(stagePath)
+		}
+	}()
+
+	var descriptors []ociImage.Descriptor
+	var diffIDs []string
+	for _, l := range layers {
+		blobPath, err := l.blobPath()
+		if err != nil {
+			return "", err
+		}
+		err = linkBlob(blobPath, stagePath, l.descriptor.Digest)
+		if err != nil {
+			return "", err
+		}
+		descriptors = append(descriptors, l.descriptor)
+		diffIDs = append(diffIDs, l.diffID)
+	}
+	for _, digest := range m.GetLayerDigests() {
+		algo, hash, err := util.SplitOCILayerID(digest)
+		if err != nil {
+			return "", err
+		}
+		err = linkBlob(path.Join(a.CurrentImagePath, "blobs", algo, hash), stagePath, digest)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	config, manifest := m.Flatten(descriptors, diffIDs)
+	err = writeOCILayout(stagePath, m.GetRefName(), config, manifest)
+	if err != nil {
+		return "", err
+	}
+	success = true
+	return stagePath, nil
+}
+
+// linkBlob places the blob at src into the OCI image layout at layoutPath,
+// hard linking it where possible.
+func linkBlob(src, layoutPath, digest string) error {
+	algo, hash, err := util.SplitOCILayerID(digest)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Join(layoutPath, "blobs", algo), 0755)
+	if err != nil {
+		return err
+	}
+	dst := path.Join(layoutPath, "blobs", algo, hash)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return fileutil.CopyRegularFile(src, dst)
+}
+
+// writeOCILayout writes the oci-layout file, the given config and manifest, and
+// a ref pointing at the manifest into the OCI image layout at layoutPath. The
+// manifest's config descriptor is filled in from the written config.
+func writeOCILayout(layoutPath, refName string, config ociImage.Image, manifest ociImage.Manifest) error {
+	for _, f := range []string{"blobs/sha256", "refs"} {
+		err := os.MkdirAll(path.Join(layoutPath, f), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	ociLayoutBlob, err := json.Marshal(OCILayoutValue)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(layoutPath, "oci-layout"), ociLayoutBlob, 0644)
+	if err != nil {
+		return err
+	}
+
+	configAlgo, configHash, configSize, err := util.MarshalHashAndWrite(layoutPath, config)
+	if err != nil {
+		return err
+	}
+	manifest.Versioned = specs.Versioned{
+		SchemaVersion: OCISchemaVersion,
+		MediaType:     ociImage.MediaTypeImageManifest,
+	}
+	manifest.Config = ociImage.Descriptor{
+		MediaType: ociImage.MediaTypeImageConfig,
+		Digest:    configAlgo + ":" + configHash,
+		Size:      int64(configSize),
+	}
+	manAlgo, manHash, manSize, err := util.MarshalHashAndWrite(layoutPath, manifest)
+	if err != nil {
+		return err
+	}
+
+	ref := ociImage.Descriptor{
+		MediaType: ociImage.MediaTypeImageManifest,
+		Digest:    manAlgo + ":" + manHash,
+		Size:      int64(manSize),
+	}
+	refBlob, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(layoutPath, "refs", refName), refBlob, 0644)
+}
@@ -413,6 +413,8 @@ func (a *ACBuild) beginFromRemoteImage(start string, insecure bool) error {
 		DepStoreExpandedPath: tmpDepStoreExpandedPath,
 		Insecure:             insecure,
 		Debug:                a.Debug,
+		Retries:              a.FetchRetries,
+		Timeout:              a.FetchTimeout,
 	}
 
 	err = reg.Fetch(app.Name, labels, 0, false)
@@ -462,6 +464,18 @@ func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) (err e
 	}
 	defer os.RemoveAll(tempDir)
 
+	renderedACI, err := convertDockerImage(start, insecure, outputDir, tempDir)
+	if err != nil {
+		return err
+	}
+
+	return util.ExtractImage(renderedACI, a.CurrentImagePath, nil)
+}
+
+// convertDockerImage fetches the given image from a docker registry, and
+// squashes it into a single ACI in outputDir. The absolute path of the ACI is
+// returned.
+func convertDockerImage(start string, insecure bool, outputDir, tempDir string) (string, error) {
 	insecureConf := common.InsecureConfig{
 		SkipVerify: insecure,
 		AllowHTTP:  insecure,
@@ -480,18 +494,18 @@ func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) (err e
 	}
 	renderedACIs, err := docker2aci.ConvertRemoteRepo(start, config)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if len(renderedACIs) > 1 {
-		return fmt.Errorf("internal error: docker2aci didn't squash the image")
+		return "", fmt.Errorf("internal error: docker2aci didn't squash the image")
 	}
 	if len(renderedACIs) == 0 {
-		return fmt.Errorf("internal error: docker2aci didn't produce any images")
+		return "", fmt.Errorf("internal error: docker2aci didn't produce any images")
 	}
 	absRenderedACI, err := filepath.Abs(renderedACIs[0])
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return util.ExtractImage(absRenderedACI, a.CurrentImagePath, nil)
+	return absRenderedACI, nil
 }
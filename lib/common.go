@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/containers/build/lib/appc"
 	"github.com/containers/build/lib/oci"
@@ -69,11 +70,19 @@ type ACBuild struct {
 	OverlayWorkPath      string
 	BuildModePath        string
 	OCIExpandedBlobsPath string
+	DependencyLockPath   string
+	OwnersPath           string
 	Debug                bool
 	Mode                 BuildMode
 
+	// FetchRetries and FetchTimeout configure how images are downloaded,
+	// see registry.Registry for details.
+	FetchRetries int
+	FetchTimeout time.Duration
+
 	man      Manifest
 	lockFile *os.File
+	lockHeld bool
 }
 
 // NewACBuild returns a new ACBuild struct with sane defaults for all of the
@@ -89,6 +98,8 @@ func NewACBuild(cwd string, debug bool, buildMode BuildMode) (*ACBuild, error) {
 		OverlayWorkPath:      path.Join(cwd, defaultWorkPath, "work"),
 		BuildModePath:        path.Join(cwd, defaultWorkPath, "buildMode"),
 		OCIExpandedBlobsPath: path.Join(cwd, defaultWorkPath, "ociblobs"),
+		DependencyLockPath:   path.Join(cwd, defaultWorkPath, "dependencies.lock"),
+		OwnersPath:           path.Join(cwd, defaultWorkPath, "owners.json"),
 		Debug:                debug,
 		Mode:                 buildMode,
 	}
@@ -125,6 +136,10 @@ func (a *ACBuild) lock() error {
 		return err
 	}
 
+	if a.lockHeld {
+		return nil
+	}
+
 	if a.lockFile != nil {
 		return fmt.Errorf("lock already held by this ACBuild")
 	}
@@ -155,6 +170,10 @@ func (a *ACBuild) lock() error {
 }
 
 func (a *ACBuild) unlock() error {
+	if a.lockHeld {
+		return nil
+	}
+
 	if a.lockFile == nil {
 		return fmt.Errorf("lock isn't held by this ACBuild")
 	}
@@ -178,6 +197,31 @@ func (a *ACBuild) unlock() error {
 	return nil
 }
 
+// HoldLock takes the lock on the build context, and keeps it until ReleaseLock
+// is called, instead of taking and releasing it around every operation. This
+// lets a series of operations run without any other acbuild process modifying
+// the build in between.
+func (a *ACBuild) HoldLock() error {
+	if a.lockHeld {
+		return nil
+	}
+	err := a.lock()
+	if err != nil {
+		return err
+	}
+	a.lockHeld = true
+	return nil
+}
+
+// ReleaseLock releases a lock taken by HoldLock.
+func (a *ACBuild) ReleaseLock() error {
+	if !a.lockHeld {
+		return nil
+	}
+	a.lockHeld = false
+	return a.unlock()
+}
+
 func GetBuildMode(cwd string) (BuildMode, error) {
 	mode, err := ioutil.ReadFile(path.Join(cwd, defaultWorkPath, "buildMode"))
 	if err != nil {
@@ -187,64 +231,29 @@ func GetBuildMode(cwd string) (BuildMode, error) {
 }
 
 func (a *ACBuild) rehashAndStoreOCIBlob(targetPath string, newLayer bool) error {
-	layerDigestWriter := sha256.New()
-
-	finishedWriting := false
-
-	tmpFile, err := ioutil.TempFile(a.ContextPath, "acbuild-layer-rehashing")
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if !finishedWriting {
-			tmpFile.Close()
-		}
-	}()
-	combinedWriter := io.MultiWriter(layerDigestWriter, tmpFile)
-
-	gzipWriter := gzip.NewWriter(combinedWriter)
-	defer func() {
-		if !finishedWriting {
-			gzipWriter.Close()
+	// The owners recorded by setOwner belong to the top layer, so a new layer
+	// starts without any.
+	var editHeader func(*tar.Header)
+	if !newLayer {
+		owners, err := a.loadOwners()
+		if err != nil {
+			return err
 		}
-	}()
-
-	diffIdWriter := sha256.New()
-	tarWriter := tar.NewWriter(io.MultiWriter(diffIdWriter, gzipWriter))
-	defer func() {
-		if !finishedWriting {
-			tarWriter.Close()
+		if owners != nil {
+			editHeader = ownerEditor(owners, "")
 		}
-	}()
-
-	err = filepath.Walk(targetPath, util.PathWalker(tarWriter, targetPath))
-	if err != nil {
-		return err
 	}
-
-	tarWriter.Close()
-	gzipWriter.Close()
-	tmpFile.Close()
-
-	finfo, err := os.Stat(tmpFile.Name())
+	tmpName, layerDigest, diffId, fsize, err := writeOCILayer(targetPath, a.ContextPath, editHeader)
 	if err != nil {
 		return err
 	}
-	fsize := finfo.Size()
-
-	finishedWriting = true
-
-	// See https://github.com/opencontainers/image-spec/blob/master/config.md for the difference between layer
-	// digest and DiffID.
-	layerDigest := hex.EncodeToString(layerDigestWriter.Sum(nil))
-	diffId := hex.EncodeToString(diffIdWriter.Sum(nil))
 
 	err = os.MkdirAll(path.Join(a.CurrentImagePath, "blobs", "sha256"), 0755)
 	if err != nil {
 		return err
 	}
 
-	err = os.Rename(tmpFile.Name(), path.Join(a.CurrentImagePath, "blobs", "sha256", layerDigest))
+	err = os.Rename(tmpName, path.Join(a.CurrentImagePath, "blobs", "sha256", layerDigest))
 	if err != nil {
 		return err
 	}
@@ -275,6 +284,12 @@ func (a *ACBuild) rehashAndStoreOCIBlob(targetPath string, newLayer bool) error
 	default:
 		return fmt.Errorf("mismatch between build mode and manifest type?!")
 	}
+	if newLayer {
+		err = os.Remove(a.OwnersPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	if !newLayer && oldTopLayerHash != "" {
 		err = os.Remove(path.Join(a.CurrentImagePath, "blobs", strings.Replace(oldTopLayerHash, ":", "/", -1)))
 		if err != nil {
@@ -284,3 +299,62 @@ func (a *ACBuild) rehashAndStoreOCIBlob(targetPath string, newLayer bool) error
 
 	return nil
 }
+
+// writeOCILayer tars and gzips the contents of targetPath into a temporary file
+// in tmpDir, and returns the name of the file along with the layer's digest,
+// DiffID and size. If editHeader isn't nil, it's called with every header
+// before it's written.
+func writeOCILayer(targetPath, tmpDir string, editHeader func(*tar.Header)) (tmpName, layerDigest, diffId string, size int64, err error) {
+	layerDigestWriter := sha256.New()
+
+	finishedWriting := false
+
+	tmpFile, err := ioutil.TempFile(tmpDir, "acbuild-layer-rehashing")
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	defer func() {
+		if !finishedWriting {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	combinedWriter := io.MultiWriter(layerDigestWriter, tmpFile)
+
+	gzipWriter := gzip.NewWriter(combinedWriter)
+	defer func() {
+		if !finishedWriting {
+			gzipWriter.Close()
+		}
+	}()
+
+	diffIdWriter := sha256.New()
+	tarWriter := tar.NewWriter(io.MultiWriter(diffIdWriter, gzipWriter))
+	defer func() {
+		if !finishedWriting {
+			tarWriter.Close()
+		}
+	}()
+
+	err = filepath.Walk(targetPath, util.EditingPathWalker(tarWriter, targetPath, editHeader))
+	if err != nil {
+		return "", "", "", 0, err
+	}
+
+	tarWriter.Close()
+	gzipWriter.Close()
+	tmpFile.Close()
+
+	finfo, err := os.Stat(tmpFile.Name())
+	if err != nil {
+		return "", "", "", 0, err
+	}
+
+	finishedWriting = true
+
+	// See https://github.com/opencontainers/image-spec/blob/master/config.md for the difference between layer
+	// digest and DiffID.
+	layerDigest = hex.EncodeToString(layerDigestWriter.Sum(nil))
+	diffId = hex.EncodeToString(diffIdWriter.Sum(nil))
+	return tmpFile.Name(), layerDigest, diffId, finfo.Size(), nil
+}
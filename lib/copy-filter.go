@@ -0,0 +1,196 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rkt/rkt/pkg/fileutil"
+	"github.com/rkt/rkt/pkg/user"
+
+	"github.com/containers/build/util"
+)
+
+// IgnoreFileName is the name of the file, in the build context, listing the
+// files that are left out when copying from the local filesystem.
+const IgnoreFileName = ".acbuildignore"
+
+// copyFilter picks out the files left out when copying from the local
+// filesystem. A nil *copyFilter leaves out nothing.
+type copyFilter struct {
+	ign     *util.Ignore
+	context string
+}
+
+// newCopyFilter returns the filter for the ignore file and patterns in opts.
+func newCopyFilter(opts CopyOptions) (*copyFilter, error) {
+	context := opts.Context
+	if context == "" {
+		context = "."
+	}
+	context, err := filepath.Abs(context)
+	if err != nil {
+		return nil, err
+	}
+	ign, err := util.ReadIgnoreFile(filepath.Join(context, IgnoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range opts.Exclude {
+		if err := ign.Add(pattern); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+	}
+	return &copyFilter{ign, context}, nil
+}
+
+// relPath returns the slash separated path that patterns are matched against
+// for p, which is src or a path under it. That's the path relative to the
+// context if p is in it, or otherwise relative to the directory holding src.
+func (f *copyFilter) relPath(src, p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(f.context, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		absSrc, err := filepath.Abs(src)
+		if err != nil {
+			return "", err
+		}
+		rel, err = filepath.Rel(filepath.Dir(absSrc), abs)
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// expandSources expands the glob patterns in srcs, leaving out any ignored
+// matches. Sources that exist are used as they are, even if they're ignored
+// or contain special characters.
+func (f *copyFilter) expandSources(srcs []string) ([]string, error) {
+	var expanded []string
+	for _, src := range srcs {
+		if _, err := os.Lstat(src); err == nil || !util.HasGlobMeta(src) {
+			expanded = append(expanded, src)
+			continue
+		}
+		matches, err := util.Glob(src)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, m := range matches {
+			ignored, err := f.ignoredMatch(m)
+			if err != nil {
+				return nil, err
+			}
+			if !ignored {
+				expanded = append(expanded, m)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no files match %q", src)
+		}
+	}
+	return expanded, nil
+}
+
+// ignoredMatch returns whether the match of a glob pattern m, or any of the
+// directories holding it, is ignored.
+func (f *copyFilter) ignoredMatch(m string) (bool, error) {
+	if f.ign.Empty() {
+		return false, nil
+	}
+	info, err := os.Lstat(m)
+	if err != nil {
+		return false, err
+	}
+	rel, err := f.relPath(m, m)
+	if err != nil {
+		return false, err
+	}
+	for dir := path.Dir(rel); dir != "." && dir != "/" && !strings.HasPrefix(dir, ".."); dir = path.Dir(dir) {
+		if f.ign.Match(dir, true) {
+			return true, nil
+		}
+	}
+	return f.ign.Match(rel, info.IsDir()), nil
+}
+
+// copyTree copies src to dest like fileutil.CopyTree, leaving out the ignored
+// files under src.
+func (f *copyFilter) copyTree(src, dest string) error {
+	if f == nil || f.ign.Empty() {
+		return fileutil.CopyTree(src, dest, user.NewBlankUidRange())
+	}
+
+	src = filepath.Clean(src)
+	dirTimes := make(map[string]time.Time)
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != src {
+			rel, err := f.relPath(src, p)
+			if err != nil {
+				return err
+			}
+			if f.ign.Match(rel, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		target := filepath.Join(dest, p[len(src):])
+		if !info.IsDir() {
+			return fileutil.CopyTree(p, target, user.NewBlankUidRange())
+		}
+		if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if err := os.Lchown(target, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, info.Mode()); err != nil {
+			return err
+		}
+		dirTimes[target] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Copying files into the directories changes their times, so they're
+	// restored afterwards.
+	for dir, mtime := range dirTimes {
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rkt/rkt/pkg/fileutil"
+	"github.com/rkt/rkt/pkg/user"
+
+	"github.com/containers/build/util"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// CopyFromBuild copies the file or directory at from in the build src to the
+// path to in the current build. The files of src's dependencies or base images
+// are included, with the upper layers taking precedence, the same way they're
+// seen by the run subcommand.
+func (a *ACBuild) CopyFromBuild(src *ACBuild, from, to string, insecure bool, opts CopyOptions) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	return a.copyFromBuild(src, from, to, insecure, opts)
+}
+
+// CopyFromImage copies the file or directory at from in the given image to
+// the path to in the current build. The image may be a local ACI or OCI image,
+// an appc image name, or a docker:// reference, the same as for Begin.
+func (a *ACBuild) CopyFromImage(image, from, to string, insecure bool, opts CopyOptions) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	tmpDir, err := ioutil.TempDir(a.ContextPath, "copy-from-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mode, err := imageBuildMode(image, tmpDir)
+	if err != nil {
+		return err
+	}
+	src, err := NewACBuild(tmpDir, a.Debug, mode)
+	if err != nil {
+		return err
+	}
+	src.FetchRetries = a.FetchRetries
+	src.FetchTimeout = a.FetchTimeout
+
+	err = src.Begin(image, insecure, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := src.End(); err == nil {
+			err = err1
+		}
+	}()
+
+	return a.copyFromBuild(src, from, to, insecure, opts)
+}
+
+func (a *ACBuild) copyFromBuild(src *ACBuild, from, to string, insecure bool, opts CopyOptions) (err error) {
+	if err = src.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := src.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	layers, err := src.layerPaths(insecure)
+	if err != nil {
+		return err
+	}
+
+	stagingDir, err := ioutil.TempDir(a.ContextPath, "copy-from-staging-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	staged := path.Join(stagingDir, "src")
+
+	err = stageLayeredPath(layers, from, staged)
+	if err != nil {
+		return err
+	}
+
+	switch a.Mode {
+	case BuildModeAppC:
+		return a.copyToTargetAppC(staged, to, opts, nil)
+	case BuildModeOCI:
+		return a.copyToTargetOCI(staged, to, opts, nil)
+	}
+	return fmt.Errorf("unknown build mode: %s", a.Mode)
+}
+
+// layerPaths returns the directories holding the layers of the build's
+// filesystem, from the bottom up, fetching its dependencies if needed.
+func (a *ACBuild) layerPaths(insecure bool) ([]string, error) {
+	for _, p := range []string{a.DepStoreExpandedPath, a.DepStoreTarPath} {
+		err := os.MkdirAll(p, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch a.Mode {
+	case BuildModeOCI:
+		return a.generateOverlayPathsOCI(insecure)
+	case BuildModeAppC:
+		return a.generateOverlayPathsAppC(insecure)
+	}
+	return nil, fmt.Errorf("unknown build mode: %s", a.Mode)
+}
+
+// imageBuildMode returns the build mode an image should be opened in. Local
+// files are checked for an OCI image layout, using tmpDir as scratch space,
+// and anything else is an appc image.
+func imageBuildMode(image, tmpDir string) (BuildMode, error) {
+	if image == "" || (image[0] != '.' && image[0] != '/') {
+		return BuildModeAppC, nil
+	}
+	finfo, err := os.Stat(image)
+	if err != nil {
+		return "", err
+	}
+	if finfo.IsDir() {
+		return BuildModeAppC, nil
+	}
+	checkDir := path.Join(tmpDir, "check")
+	err = os.Mkdir(checkDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(checkDir)
+	err = util.ExtractImage(image, checkDir, map[string]struct{}{"oci-layout": {}})
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path.Join(checkDir, "oci-layout")); err == nil {
+		return BuildModeOCI, nil
+	}
+	return BuildModeAppC, nil
+}
+
+// stageLayeredPath copies the file or directory at p in the filesystem made by
+// stacking layers, from the bottom up, to staged.
+func stageLayeredPath(layers []string, p, staged string) error {
+	p = path.Clean("/" + p)
+	found := false
+	for _, layer := range layers {
+		if whitedOut(layer, p) {
+			err := os.RemoveAll(staged)
+			if err != nil {
+				return err
+			}
+			found = false
+		}
+
+		src := path.Join(layer, p)
+		info, err := os.Lstat(src)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return err
+		}
+		if !info.IsDir() {
+			err := os.RemoveAll(staged)
+			if err != nil {
+				return err
+			}
+		}
+		err = mergeTree(src, staged)
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("%s: no such file or directory", p)
+	}
+	return nil
+}
+
+// whitedOut returns whether layer hides p, or one of its parent directories,
+// from the layers below it.
+func whitedOut(layer, p string) bool {
+	for p != "/" {
+		dir, base := path.Split(p)
+		if _, err := os.Lstat(path.Join(layer, dir, whiteoutPrefix+base)); err == nil {
+			return true
+		}
+		p = path.Clean(dir)
+		if _, err := os.Lstat(path.Join(layer, p, opaqueWhiteout)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeTree copies src to dest like fileutil.CopyTree, but merges directories
+// into existing ones, replaces existing files, and applies any whiteouts in
+// src to what is already at dest.
+func mergeTree(src, dest string) error {
+	uidRange := user.NewBlankUidRange()
+	cleanSrc := filepath.Clean(src)
+	return filepath.Walk(cleanSrc, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, p[len(cleanSrc):])
+
+		name := info.Name()
+		switch {
+		case p == cleanSrc:
+		case name == opaqueWhiteout:
+			return nil
+		case strings.HasPrefix(name, whiteoutPrefix):
+			return os.RemoveAll(filepath.Join(filepath.Dir(target), strings.TrimPrefix(name, whiteoutPrefix)))
+		}
+
+		if !info.IsDir() {
+			err := os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+			return fileutil.CopyTree(p, target, uidRange)
+		}
+
+		targetInfo, err := os.Lstat(target)
+		switch {
+		case os.IsNotExist(err):
+			err = os.Mkdir(target, info.Mode().Perm())
+		case err != nil:
+			return err
+		case !targetInfo.IsDir():
+			err = os.Remove(target)
+			if err == nil {
+				err = os.Mkdir(target, info.Mode().Perm())
+			}
+		default:
+			if _, err := os.Lstat(filepath.Join(p, opaqueWhiteout)); err == nil {
+				err = clearDir(target)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		err = os.Lchown(target, int(stat.Uid), int(stat.Gid))
+		if err != nil {
+			return err
+		}
+		return os.Chmod(target, info.Mode())
+	})
+}
+
+func clearDir(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		err := os.RemoveAll(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func writeLayer(t *testing.T, dir string, files map[string]string) string {
+	for name, contents := range files {
+		p := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		err = ioutil.WriteFile(p, []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	return dir
+}
+
+func listTree(t *testing.T, root string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[strings.TrimPrefix(p, root+"/")] = string(contents)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return files
+}
+
+func TestStageLayeredPath(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "acbuild-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	layers := []string{
+		writeLayer(t, filepath.Join(tmpDir, "1"), map[string]string{
+			"etc/app/a.conf":   "a1",
+			"etc/app/b.conf":   "b1",
+			"etc/app/old.conf": "old",
+			"etc/other/c.conf": "c1",
+		}),
+		writeLayer(t, filepath.Join(tmpDir, "2"), map[string]string{
+			"etc/app/a.conf":         "a2",
+			"etc/app/.wh.old.conf":   "",
+			"etc/other/.wh..wh..opq": "",
+			"etc/other/d.conf":       "d2",
+		}),
+	}
+
+	err = os.Mkdir(filepath.Join(tmpDir, "staged"), 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	type testcase struct {
+		path   string
+		wanted map[string]string
+	}
+	cases := []testcase{
+		{"/etc/app", map[string]string{"a.conf": "a2", "b.conf": "b1"}},
+		{"etc/app/b.conf", map[string]string{"": "b1"}},
+		{"/etc/other", map[string]string{"d.conf": "d2"}},
+	}
+	for i, c := range cases {
+		staged := filepath.Join(tmpDir, "staged", strconv.Itoa(i))
+		err := stageLayeredPath(layers, c.path, staged)
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+			continue
+		}
+		var got map[string]string
+		if info, err := os.Stat(staged); err == nil && !info.IsDir() {
+			contents, _ := ioutil.ReadFile(staged)
+			got = map[string]string{"": string(contents)}
+		} else {
+			got = listTree(t, staged)
+		}
+		if !equalFiles(got, c.wanted) {
+			t.Errorf("%s: staged %v, wanted %v", c.path, got, c.wanted)
+		}
+	}
+
+	for _, p := range []string{"/etc/app/old.conf", "/etc/other/c.conf", "/missing"} {
+		err := stageLayeredPath(layers, p, filepath.Join(tmpDir, "staged", "missing"))
+		if err == nil {
+			t.Errorf("%s: no error for a path that isn't in the layers", p)
+		}
+	}
+}
+
+func equalFiles(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := b[k]; !ok || v != a[k] {
+			return false
+		}
+	}
+	return true
+}
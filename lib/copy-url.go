@@ -0,0 +1,177 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/rkt/rkt/pkg/fileutil"
+	"github.com/rkt/rkt/pkg/user"
+
+	"github.com/containers/build/util"
+)
+
+// IsURL returns whether src is an http or https URL, which the copy commands
+// download instead of reading from the local filesystem.
+func IsURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// CopyFromURL downloads the file at rawurl and copies it to the path to in
+// the current build. If to ends with a slash, the file is copied into that
+// directory under the last element of the URL's path. If extract is set, the
+// file is a tar archive, optionally compressed with gzip, bzip2 or xz, or a
+// zip archive, whose contents are unpacked into the directory to instead. If
+// sum isn't empty, the download fails unless its SHA-256 checksum, in hex,
+// matches it.
+func (a *ACBuild) CopyFromURL(rawurl, to string, extract bool, sum string, opts CopyOptions) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if !extract && strings.HasSuffix(to, "/") {
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			return fmt.Errorf("can't tell the file name from %s, give the full path to copy it to", rawurl)
+		}
+		to = path.Join(to, name)
+	}
+
+	stagingDir, err := ioutil.TempDir(a.ContextPath, "copy-url-staging-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	downloaded := path.Join(stagingDir, "download")
+
+	err = os.MkdirAll(a.DepStoreTarPath, 0755)
+	if err != nil {
+		return err
+	}
+	reg := a.depRegistry(opts.Insecure)
+	err = reg.DownloadFile(rawurl, downloaded, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if sum != "" {
+		err = checkSHA256(downloaded, sum)
+		if err != nil {
+			return fmt.Errorf("%s: %v", rawurl, err)
+		}
+	}
+
+	var root string
+	switch a.Mode {
+	case BuildModeAppC:
+		root = path.Join(a.CurrentImagePath, aci.RootfsDir)
+	case BuildModeOCI:
+		root, err = a.expandTopOCILayer()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown build mode: %s", a.Mode)
+	}
+	target := path.Join(root, to)
+
+	if extract {
+		extracted := path.Join(stagingDir, "extracted")
+		err = os.Mkdir(extracted, 0755)
+		if err != nil {
+			return err
+		}
+		err = util.ExtractArchive(downloaded, extracted)
+		if err != nil {
+			return fmt.Errorf("error extracting %s: %v", rawurl, err)
+		}
+		err = os.MkdirAll(target, 0755)
+		if err != nil {
+			return err
+		}
+		err = mergeTree(extracted, target)
+		if err != nil {
+			return err
+		}
+		// Only what was in the archive is given the owner and mode, not
+		// what was already in the directory.
+		infos, err := ioutil.ReadDir(extracted)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			err = a.applyCopyOptions(root, path.Join(target, info.Name()), opts)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		err = os.MkdirAll(path.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		err = fileutil.CopyTree(downloaded, target, user.NewBlankUidRange())
+		if err != nil {
+			return err
+		}
+		err = a.applyCopyOptions(root, target, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.Mode == BuildModeOCI {
+		return a.rehashAndStoreOCIBlob(root, false)
+	}
+	return nil
+}
+
+// checkSHA256 returns an error if the SHA-256 checksum of the file at p isn't
+// sum.
+func checkSHA256(p, sum string) error {
+	sum = strings.ToLower(strings.TrimPrefix(sum, "sha256:"))
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != sum {
+		return fmt.Errorf("checksum mismatch, expected sha256:%s but got sha256:%s", sum, actual)
+	}
+	return nil
+}
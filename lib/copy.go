@@ -20,16 +20,37 @@ import (
 	"path"
 
 	"github.com/appc/spec/aci"
-	"github.com/rkt/rkt/pkg/fileutil"
-	"github.com/rkt/rkt/pkg/user"
 
 	"github.com/containers/build/lib/oci"
 	"github.com/containers/build/util"
 )
 
+// CopyOptions changes how files are copied into the build. The zero value
+// copies files as they are.
+type CopyOptions struct {
+	// Chown, if set, is the owner given to the copied files, of the form
+	// USER[:GROUP]. Each of them is either a numeric ID, or a name looked up
+	// in the image's /etc/passwd or /etc/group. Without a group, the group ID
+	// is the same as the user ID.
+	Chown string
+	// Chmod, if not zero, is the mode given to the copied files and
+	// directories.
+	Chmod os.FileMode
+	// Insecure allows fetching the build's dependencies over http, to look
+	// up the names in Chown.
+	Insecure bool
+	// Exclude is a list of patterns, with the syntax of a .gitignore file,
+	// for files to leave out when copying from the local filesystem. They're
+	// added to the patterns in the context's .acbuildignore file.
+	Exclude []string
+	// Context is the directory holding the .acbuildignore file, which the
+	// patterns are relative to. It defaults to the current directory.
+	Context string
+}
+
 // CopyToDir will copy all elements specified in the froms slice into the
 // directory inside the current ACI specified by the to string.
-func (a *ACBuild) CopyToDir(froms []string, to string) (err error) {
+func (a *ACBuild) CopyToDir(froms []string, to string, opts CopyOptions) (err error) {
 	if err = a.lock(); err != nil {
 		return err
 	}
@@ -39,17 +60,27 @@ func (a *ACBuild) CopyToDir(froms []string, to string) (err error) {
 		}
 	}()
 
+	filter, err := newCopyFilter(opts)
+	if err != nil {
+		return err
+	}
+	froms, err = filter.expandSources(froms)
+	if err != nil {
+		return err
+	}
+
 	switch a.Mode {
 	case BuildModeAppC:
-		return a.copyToDirAppC(froms, to)
+		return a.copyToDirAppC(froms, to, opts, filter)
 	case BuildModeOCI:
-		return a.copyToDirOCI(froms, to)
+		return a.copyToDirOCI(froms, to, opts, filter)
 	}
 	return fmt.Errorf("unknown build mode: %s", a.Mode)
 }
 
-func (a *ACBuild) copyToDirAppC(froms []string, to string) error {
-	target := path.Join(a.CurrentImagePath, aci.RootfsDir, to)
+func (a *ACBuild) copyToDirAppC(froms []string, to string, opts CopyOptions, filter *copyFilter) error {
+	root := path.Join(a.CurrentImagePath, aci.RootfsDir)
+	target := path.Join(root, to)
 
 	targetInfo, err := os.Stat(target)
 	switch {
@@ -67,7 +98,11 @@ func (a *ACBuild) copyToDirAppC(froms []string, to string) error {
 	for _, from := range froms {
 		_, file := path.Split(from)
 		tmptarget := path.Join(target, file)
-		err := fileutil.CopyTree(from, tmptarget, user.NewBlankUidRange())
+		err := filter.copyTree(from, tmptarget)
+		if err != nil {
+			return err
+		}
+		err = a.applyCopyOptions(root, tmptarget, opts)
 		if err != nil {
 			return err
 		}
@@ -109,7 +144,7 @@ func (a *ACBuild) expandTopOCILayer() (string, error) {
 	return targetPath, nil
 }
 
-func (a *ACBuild) copyToDirOCI(froms []string, to string) error {
+func (a *ACBuild) copyToDirOCI(froms []string, to string, opts CopyOptions, filter *copyFilter) error {
 	currentLayer, err := a.expandTopOCILayer()
 	if err != nil {
 		return err
@@ -132,7 +167,11 @@ func (a *ACBuild) copyToDirOCI(froms []string, to string) error {
 	for _, from := range froms {
 		_, file := path.Split(from)
 		tmptarget := path.Join(targetPath, file)
-		err := fileutil.CopyTree(from, tmptarget, user.NewBlankUidRange())
+		err := filter.copyTree(from, tmptarget)
+		if err != nil {
+			return err
+		}
+		err = a.applyCopyOptions(currentLayer, tmptarget, opts)
 		if err != nil {
 			return err
 		}
@@ -143,7 +182,7 @@ func (a *ACBuild) copyToDirOCI(froms []string, to string) error {
 
 // CopyToTarget will copy a single file/directory from the from string to the
 // path specified by the to string inside the current ACI.
-func (a *ACBuild) CopyToTarget(from string, to string) (err error) {
+func (a *ACBuild) CopyToTarget(from string, to string, opts CopyOptions) (err error) {
 	if err = a.lock(); err != nil {
 		return err
 	}
@@ -153,17 +192,30 @@ func (a *ACBuild) CopyToTarget(from string, to string) (err error) {
 		}
 	}()
 
+	filter, err := newCopyFilter(opts)
+	if err != nil {
+		return err
+	}
+	froms, err := filter.expandSources([]string{from})
+	if err != nil {
+		return err
+	}
+	if len(froms) != 1 {
+		return fmt.Errorf("%q matches %d files, use copy-to-dir to copy more than one", from, len(froms))
+	}
+
 	switch a.Mode {
 	case BuildModeAppC:
-		return a.copyToTargetAppC(from, to)
+		return a.copyToTargetAppC(froms[0], to, opts, filter)
 	case BuildModeOCI:
-		return a.copyToTargetOCI(from, to)
+		return a.copyToTargetOCI(froms[0], to, opts, filter)
 	}
 	return fmt.Errorf("unknown build mode: %s", a.Mode)
 }
 
-func (a *ACBuild) copyToTargetAppC(from string, to string) error {
-	target := path.Join(a.CurrentImagePath, aci.RootfsDir, to)
+func (a *ACBuild) copyToTargetAppC(from string, to string, opts CopyOptions, filter *copyFilter) error {
+	root := path.Join(a.CurrentImagePath, aci.RootfsDir)
+	target := path.Join(root, to)
 
 	dir, _ := path.Split(target)
 	if dir != "" {
@@ -173,10 +225,14 @@ func (a *ACBuild) copyToTargetAppC(from string, to string) error {
 		}
 	}
 
-	return fileutil.CopyTree(from, target, user.NewBlankUidRange())
+	err := filter.copyTree(from, target)
+	if err != nil {
+		return err
+	}
+	return a.applyCopyOptions(root, target, opts)
 }
 
-func (a *ACBuild) copyToTargetOCI(from string, to string) error {
+func (a *ACBuild) copyToTargetOCI(from string, to string, opts CopyOptions, filter *copyFilter) error {
 	targetPath, err := a.expandTopOCILayer()
 	if err != nil {
 		return err
@@ -191,7 +247,11 @@ func (a *ACBuild) copyToTargetOCI(from string, to string) error {
 		}
 	}
 
-	err = fileutil.CopyTree(from, target, user.NewBlankUidRange())
+	err = filter.copyTree(from, target)
+	if err != nil {
+		return err
+	}
+	err = a.applyCopyOptions(targetPath, target, opts)
 	if err != nil {
 		return err
 	}
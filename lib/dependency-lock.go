@@ -0,0 +1,302 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/containers/build/lib/appc"
+	"github.com/containers/build/registry"
+	"github.com/containers/build/util"
+)
+
+var errDependenciesChanged = fmt.Errorf("the image's dependencies have changed since they were locked, re-run \"acbuild dependency lock\"")
+
+// DependencyLock pins the images that an appc build's dependencies resolve to,
+// so that the same script builds on top of the same images every time.
+type DependencyLock struct {
+	Dependencies []LockedDependency `json:"dependencies"`
+}
+
+// LockedDependency is a dependency from the image's manifest, along with the
+// exact image it resolved to.
+type LockedDependency struct {
+	ImageName types.ACIdentifier `json:"imageName"`
+	Labels    types.Labels       `json:"labels,omitempty"`
+	ImageID   string             `json:"imageID"`
+	Size      uint               `json:"size,omitempty"`
+
+	// Images lists every image rendered for this dependency, including its
+	// transitive dependencies, in the order they are layered. The last entry
+	// is the dependency itself.
+	Images []LockedDependency `json:"images,omitempty"`
+}
+
+// ReadDependencyLock reads the dependency lock stored at lockPath.
+func ReadDependencyLock(lockPath string) (*DependencyLock, error) {
+	blob, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	lock := &DependencyLock{}
+	err = json.Unmarshal(blob, lock)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dependency lock %s: %v", lockPath, err)
+	}
+	return lock, nil
+}
+
+// WriteDependencyLock writes the given dependency lock to lockPath.
+func WriteDependencyLock(lock *DependencyLock, lockPath string) error {
+	blob, err := json.MarshalIndent(lock, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(lockPath, append(blob, '\n'), 0644)
+}
+
+// LockDependencies fetches every dependency of the current build, and records
+// the exact images they resolve to in the build context. Any following run or
+// write will fail if the dependencies stop resolving to the same images. If
+// pinManifest is set, the image IDs and sizes of the dependencies are also
+// written into the manifest.
+func (a *ACBuild) LockDependencies(insecure, pinManifest bool) (lock *DependencyLock, err error) {
+	if err = a.lock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	reg, man, err := a.fetchDependencies(insecure)
+	if err != nil {
+		return nil, err
+	}
+	err = checkDependencyGraph(reg, man)
+	if err != nil {
+		return nil, err
+	}
+
+	lock = &DependencyLock{Dependencies: []LockedDependency{}}
+	for _, dep := range man.Dependencies {
+		locked, err := resolveDependency(reg, dep)
+		if err != nil {
+			return nil, err
+		}
+		lock.Dependencies = append(lock.Dependencies, *locked)
+	}
+
+	if pinManifest {
+		pins := make(types.Dependencies, len(lock.Dependencies))
+		for i, locked := range lock.Dependencies {
+			id, err := types.NewHash(locked.ImageID)
+			if err != nil {
+				return nil, err
+			}
+			pins[i] = types.Dependency{
+				ImageName: locked.ImageName,
+				ImageID:   id,
+				Labels:    locked.Labels,
+				Size:      locked.Size,
+			}
+		}
+		err = a.man.(*appc.Manifest).PinDependencies(pins)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = WriteDependencyLock(lock, a.DependencyLockPath)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// UseDependencyLock copies the dependency lock at lockPath into the build
+// context, so that any following run or write will fail if the dependencies
+// don't resolve to the images it records.
+func (a *ACBuild) UseDependencyLock(lockPath string) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	m, ok := a.man.(*appc.Manifest)
+	if !ok {
+		return fmt.Errorf("dependencies only supported in appc builds")
+	}
+
+	lock, err := ReadDependencyLock(lockPath)
+	if err != nil {
+		return err
+	}
+	err = checkLockMatchesManifest(lock, m.Get())
+	if err != nil {
+		return err
+	}
+	return WriteDependencyLock(lock, a.DependencyLockPath)
+}
+
+// GetDependencyLock returns the dependency lock of the current build, or nil
+// if its dependencies haven't been locked.
+func (a *ACBuild) GetDependencyLock() (*DependencyLock, error) {
+	lock, err := ReadDependencyLock(a.DependencyLockPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return lock, err
+}
+
+// checkDependencyLock returns an error if the dependencies in man no longer
+// resolve to the images recorded in the build's dependency lock. If requireAll
+// is false, dependencies that haven't been fetched into the store yet are
+// skipped instead of causing an error.
+func (a *ACBuild) checkDependencyLock(man *schema.ImageManifest, reg registry.Registry, requireAll bool) error {
+	lock, err := a.GetDependencyLock()
+	if err != nil || lock == nil {
+		return err
+	}
+
+	err = checkLockMatchesManifest(lock, man)
+	if err != nil {
+		return err
+	}
+
+	for i, dep := range man.Dependencies {
+		_, err := reg.GetACI(dep.ImageName, dep.Labels)
+		if !requireAll && (err == registry.ErrNotFound || os.IsNotExist(err)) {
+			continue
+		}
+		resolved, err := resolveDependency(reg, dep)
+		if err != nil {
+			return err
+		}
+		err = compareLocked(lock.Dependencies[i], *resolved)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkLockMatchesManifest(lock *DependencyLock, man *schema.ImageManifest) error {
+	if len(lock.Dependencies) != len(man.Dependencies) {
+		return errDependenciesChanged
+	}
+	for i, dep := range man.Dependencies {
+		locked := lock.Dependencies[i]
+		if dep.ImageName != locked.ImageName || !labelsEqual(dep.Labels, locked.Labels) {
+			return errDependenciesChanged
+		}
+		if dep.ImageID != nil && !strings.HasPrefix(locked.ImageID, dep.ImageID.String()) {
+			return fmt.Errorf("dependency %s has image ID %s in the manifest, but is locked to %s",
+				dep.ImageName, dep.ImageID, locked.ImageID)
+		}
+	}
+	return nil
+}
+
+// compareLocked returns an error describing the first image that differs
+// between the locked and resolved versions of a dependency.
+func compareLocked(locked, resolved LockedDependency) error {
+	if locked.ImageID != resolved.ImageID {
+		return fmt.Errorf("dependency %s resolved to %s, but is locked to %s",
+			locked.ImageName, resolved.ImageID, locked.ImageID)
+	}
+	if len(locked.Images) != len(resolved.Images) {
+		return fmt.Errorf("dependency %s resolved to %d images, but is locked to %d",
+			locked.ImageName, len(resolved.Images), len(locked.Images))
+	}
+	for i := range locked.Images {
+		if locked.Images[i].ImageID != resolved.Images[i].ImageID {
+			return fmt.Errorf("image %s needed by dependency %s resolved to %s, but is locked to %s",
+				resolved.Images[i].ImageName, locked.ImageName,
+				resolved.Images[i].ImageID, locked.Images[i].ImageID)
+		}
+	}
+	return nil
+}
+
+// resolveDependency finds the image in the store that dep resolves to, along
+// with all of the images layered under it.
+func resolveDependency(reg registry.Registry, dep types.Dependency) (*LockedDependency, error) {
+	key, err := reg.GetACI(dep.ImageName, dep.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := &LockedDependency{
+		ImageName: dep.ImageName,
+		Labels:    dep.Labels,
+		ImageID:   key,
+		Size:      imageSize(reg, key),
+	}
+
+	keys, err := genDeplist(path.Join(reg.DepStoreExpandedPath, key), reg)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		man, err := util.GetManifest(path.Join(reg.DepStoreExpandedPath, k))
+		if err != nil {
+			return nil, err
+		}
+		locked.Images = append(locked.Images, LockedDependency{
+			ImageName: man.Name,
+			Labels:    man.Labels,
+			ImageID:   k,
+			Size:      imageSize(reg, k),
+		})
+	}
+	return locked, nil
+}
+
+// imageSize returns the download size of the image with the given key, or 0
+// if it isn't known.
+func imageSize(reg registry.Registry, key string) uint {
+	size, err := reg.GetImageSize(key)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+func labelsEqual(l1, l2 types.Labels) bool {
+	if len(l1) != len(l2) {
+		return false
+	}
+	for _, l := range l1 {
+		val, ok := l2.Get(l.Name.String())
+		if !ok || val != l.Value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,279 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/containers/build/lib/appc"
+	"github.com/containers/build/registry"
+)
+
+// DependencyTree is the resolved dependency graph of an appc build.
+type DependencyTree struct {
+	Dependencies []*DependencyNode `json:"dependencies"`
+
+	// Problems lists anything that would stop the dependencies from being
+	// rendered, such as cycles or conflicting label requirements.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// DependencyNode is a single image in a DependencyTree.
+type DependencyNode struct {
+	ImageName     types.ACIdentifier `json:"imageName"`
+	Labels        types.Labels       `json:"labels,omitempty"`
+	ImageID       string             `json:"imageID,omitempty"`
+	Size          uint               `json:"size,omitempty"`
+	PathWhitelist []string           `json:"pathWhitelist,omitempty"`
+	Dependencies  []*DependencyNode  `json:"dependencies,omitempty"`
+
+	// Cycle is set when this image is also one of its own ancestors, in which
+	// case its dependencies aren't listed again.
+	Cycle bool `json:"cycle,omitempty"`
+}
+
+// RenderedImage is an image that will be layered under the rootfs of an appc
+// build when run is called.
+type RenderedImage struct {
+	ImageName     types.ACIdentifier `json:"imageName"`
+	Labels        types.Labels       `json:"labels,omitempty"`
+	ImageID       string             `json:"imageID"`
+	Size          uint               `json:"size,omitempty"`
+	PathWhitelist []string           `json:"pathWhitelist,omitempty"`
+
+	// Files is the number of files from this image that will be visible,
+	// after path whitelists and files from images above it are taken into
+	// account.
+	Files int `json:"files"`
+}
+
+// DependencyTree fetches every dependency of the current build, and returns
+// the graph of images they resolve to.
+func (a *ACBuild) DependencyTree(insecure bool) (tree *DependencyTree, err error) {
+	if err = a.lock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	reg, man, err := a.fetchDependencies(insecure)
+	if err != nil {
+		return nil, err
+	}
+	return buildDependencyTree(reg, man), nil
+}
+
+// DependencyList fetches every dependency of the current build, and returns
+// the images that will be layered under the rootfs when run is called, from
+// the bottom up.
+func (a *ACBuild) DependencyList(insecure bool) (images []RenderedImage, err error) {
+	if err = a.lock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	reg, man, err := a.fetchDependencies(insecure)
+	if err != nil {
+		return nil, err
+	}
+	tree := buildDependencyTree(reg, man)
+	if len(tree.Problems) != 0 {
+		return nil, fmt.Errorf("%s", tree.Problems[0])
+	}
+
+	images = []RenderedImage{}
+	for _, dep := range man.Dependencies {
+		key, err := reg.GetACI(dep.ImageName, dep.Labels)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := genDeplist(path.Join(reg.DepStoreExpandedPath, key), reg)
+		if err != nil {
+			return nil, err
+		}
+		files, err := reg.RenderedFiles(dep)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			depman, err := reg.GetImageManifest(k)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, RenderedImage{
+				ImageName:     depman.Name,
+				Labels:        depman.Labels,
+				ImageID:       k,
+				Size:          imageSize(reg, k),
+				PathWhitelist: depman.PathWhitelist,
+				Files:         countRootfsFiles(files[k]),
+			})
+		}
+	}
+	return images, nil
+}
+
+// fetchDependencies fetches every dependency of the current build into the
+// build context's dependency store. The lock must be held.
+func (a *ACBuild) fetchDependencies(insecure bool) (registry.Registry, *schema.ImageManifest, error) {
+	m, ok := a.man.(*appc.Manifest)
+	if !ok {
+		return registry.Registry{}, nil, fmt.Errorf("dependencies only supported in appc builds")
+	}
+	man := m.Get()
+
+	reg := a.depRegistry(insecure)
+	err := os.MkdirAll(a.DepStoreExpandedPath, 0755)
+	if err != nil {
+		return reg, nil, err
+	}
+	err = os.MkdirAll(a.DepStoreTarPath, 0755)
+	if err != nil {
+		return reg, nil, err
+	}
+
+	return reg, man, reg.FetchDeps(man.Dependencies)
+}
+
+// checkDependencyGraph returns an error if the fetched dependencies of man
+// can't be rendered, for example because they form a cycle.
+func checkDependencyGraph(reg registry.Registry, man *schema.ImageManifest) error {
+	tree := buildDependencyTree(reg, man)
+	if len(tree.Problems) != 0 {
+		return fmt.Errorf("%s", tree.Problems[0])
+	}
+	return nil
+}
+
+func buildDependencyTree(reg registry.Registry, man *schema.ImageManifest) *DependencyTree {
+	tree := &DependencyTree{Dependencies: []*DependencyNode{}}
+	for _, dep := range man.Dependencies {
+		tree.Dependencies = append(tree.Dependencies, buildDependencyNode(reg, dep, nil, tree))
+	}
+	tree.Problems = append(tree.Problems, findConflicts(tree)...)
+	return tree
+}
+
+func buildDependencyNode(reg registry.Registry, dep types.Dependency, ancestors []*DependencyNode, tree *DependencyTree) *DependencyNode {
+	node := &DependencyNode{
+		ImageName: dep.ImageName,
+		Labels:    dep.Labels,
+	}
+
+	key, err := reg.GetACI(dep.ImageName, dep.Labels)
+	if err != nil {
+		tree.Problems = append(tree.Problems, fmt.Sprintf("dependency %s couldn't be resolved: %v", imageString(dep.ImageName, dep.Labels), err))
+		return node
+	}
+	node.ImageID = key
+	node.Size = imageSize(reg, key)
+
+	for i, ancestor := range ancestors {
+		if ancestor.ImageID == key {
+			node.Cycle = true
+			var names []string
+			for _, n := range ancestors[i:] {
+				names = append(names, string(n.ImageName))
+			}
+			names = append(names, string(node.ImageName))
+			tree.Problems = append(tree.Problems, fmt.Sprintf("dependency cycle: %s", strings.Join(names, " -> ")))
+			return node
+		}
+	}
+
+	depman, err := reg.GetImageManifest(key)
+	if err != nil {
+		tree.Problems = append(tree.Problems, fmt.Sprintf("error reading manifest of %s: %v", dep.ImageName, err))
+		return node
+	}
+	node.PathWhitelist = depman.PathWhitelist
+
+	ancestors = append(ancestors, node)
+	for _, subdep := range depman.Dependencies {
+		node.Dependencies = append(node.Dependencies, buildDependencyNode(reg, subdep, ancestors, tree))
+	}
+	return node
+}
+
+// findConflicts returns a problem for every image name that appears more than
+// once in the tree and resolves to different images, which happens when
+// different dependencies ask for it with conflicting labels.
+func findConflicts(tree *DependencyTree) []string {
+	resolved := make(map[types.ACIdentifier]map[string]string)
+	var walk func(nodes []*DependencyNode)
+	walk = func(nodes []*DependencyNode) {
+		for _, n := range nodes {
+			if n.ImageID != "" {
+				if resolved[n.ImageName] == nil {
+					resolved[n.ImageName] = make(map[string]string)
+				}
+				resolved[n.ImageName][n.ImageID] = imageString(n.ImageName, n.Labels)
+			}
+			walk(n.Dependencies)
+		}
+	}
+	walk(tree.Dependencies)
+
+	var problems []string
+	for name, ids := range resolved {
+		if len(ids) < 2 {
+			continue
+		}
+		var reqs []string
+		for id, req := range ids {
+			reqs = append(reqs, fmt.Sprintf("%s resolves to %s", req, id))
+		}
+		sort.Strings(reqs)
+		problems = append(problems, fmt.Sprintf("conflicting requirements for %s: %s", name, strings.Join(reqs, ", ")))
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// countRootfsFiles returns the number of files in the given file map that are
+// in the rootfs, not counting the rootfs directory itself.
+func countRootfsFiles(fileMap map[string]struct{}) int {
+	var n int
+	for f := range fileMap {
+		if strings.HasPrefix(f, "rootfs/") {
+			n++
+		}
+	}
+	return n
+}
+
+// imageString formats an image name and its labels the same way they're
+// given to "acbuild dependency add".
+func imageString(name types.ACIdentifier, labels types.Labels) string {
+	s := string(name)
+	for _, l := range labels {
+		s += "," + string(l.Name) + "=" + l.Value
+	}
+	return s
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/containers/build/registry"
+)
+
+// storeImage places the manifest of an image into the expanded store of reg,
+// as if it had been fetched.
+func storeImage(t *testing.T, reg registry.Registry, id, name string, labels types.Labels, deps ...types.Dependency) {
+	man := schema.ImageManifest{
+		ACKind:       schema.ImageManifestKind,
+		ACVersion:    schema.AppContainerVersion,
+		Name:         *types.MustACIdentifier(name),
+		Labels:       labels,
+		Dependencies: deps,
+	}
+	blob, err := man.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := path.Join(reg.DepStoreExpandedPath, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, aci.ManifestFile), blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestStore(t *testing.T) (registry.Registry, func()) {
+	dir, err := ioutil.TempDir("", "acbuild-lib-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry.Registry{DepStoreExpandedPath: dir}, func() { os.RemoveAll(dir) }
+}
+
+func dep(name string, labels types.Labels) types.Dependency {
+	return types.Dependency{ImageName: *types.MustACIdentifier(name), Labels: labels}
+}
+
+func version(v string) types.Labels {
+	return types.Labels{{Name: *types.MustACIdentifier("version"), Value: v}}
+}
+
+func TestDependencyTree(t *testing.T) {
+	reg, cleanup := newTestStore(t)
+	defer cleanup()
+
+	storeImage(t, reg, "sha512-base", "example.com/base", nil)
+	storeImage(t, reg, "sha512-app", "example.com/app", nil, dep("example.com/base", nil))
+
+	man := &schema.ImageManifest{Dependencies: types.Dependencies{dep("example.com/app", nil)}}
+	tree := buildDependencyTree(reg, man)
+	if len(tree.Problems) != 0 {
+		t.Fatalf("unexpected problems: %v", tree.Problems)
+	}
+	if len(tree.Dependencies) != 1 {
+		t.Fatalf("expected 1 dependency, got %d", len(tree.Dependencies))
+	}
+	app := tree.Dependencies[0]
+	if app.ImageID != "sha512-app" || len(app.Dependencies) != 1 {
+		t.Fatalf("unexpected node for app: %+v", app)
+	}
+	if app.Dependencies[0].ImageID != "sha512-base" {
+		t.Errorf("unexpected node for base: %+v", app.Dependencies[0])
+	}
+}
+
+func TestDependencyTreeCycle(t *testing.T) {
+	reg, cleanup := newTestStore(t)
+	defer cleanup()
+
+	storeImage(t, reg, "sha512-a", "example.com/a", nil, dep("example.com/b", nil))
+	storeImage(t, reg, "sha512-b", "example.com/b", nil, dep("example.com/a", nil))
+
+	man := &schema.ImageManifest{Dependencies: types.Dependencies{dep("example.com/a", nil)}}
+	err := checkDependencyGraph(reg, man)
+	if err == nil || !strings.Contains(err.Error(), "example.com/a -> example.com/b -> example.com/a") {
+		t.Errorf("expected a dependency cycle error, got %v", err)
+	}
+}
+
+func TestDependencyTreeConflict(t *testing.T) {
+	reg, cleanup := newTestStore(t)
+	defer cleanup()
+
+	storeImage(t, reg, "sha512-base1", "example.com/base", version("1"))
+	storeImage(t, reg, "sha512-base2", "example.com/base", version("2"))
+	storeImage(t, reg, "sha512-a", "example.com/a", nil, dep("example.com/base", version("1")))
+	storeImage(t, reg, "sha512-b", "example.com/b", nil, dep("example.com/base", version("2")))
+
+	man := &schema.ImageManifest{Dependencies: types.Dependencies{
+		dep("example.com/a", nil),
+		dep("example.com/b", nil),
+	}}
+	err := checkDependencyGraph(reg, man)
+	if err == nil || !strings.Contains(err.Error(), "conflicting requirements for example.com/base") {
+		t.Errorf("expected a conflict error, got %v", err)
+	}
+}
@@ -56,5 +56,11 @@ func (a *ACBuild) End() error {
 		return err
 	}
 
+	// The lock file was removed along with the context, so closing it is all
+	// that's left to release the lock.
+	a.lockFile.Close()
+	a.lockFile = nil
+	a.lockHeld = false
+
 	return nil
 }
@@ -0,0 +1,111 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BaseImagesAnnotation is the annotation the base images of a build are
+// recorded in, as a JSON list of references from the bottom up. It is removed
+// when the image is written, since the base images are flattened into it.
+const BaseImagesAnnotation = "org.containers.build.base-images"
+
+// GetBaseImages returns the references of the base images of this image, from
+// the bottom up.
+func (i *Image) GetBaseImages() ([]string, error) {
+	val := i.getAnnotation(BaseImagesAnnotation)
+	if val == "" {
+		return nil, nil
+	}
+	var refs []string
+	err := json.Unmarshal([]byte(val), &refs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s annotation: %v", BaseImagesAnnotation, err)
+	}
+	return refs, nil
+}
+
+// AddBaseImage adds the base image with the given reference on top of any
+// existing ones. If it is already a base image nothing is changed.
+func (i *Image) AddBaseImage(ref string) error {
+	refs, err := i.GetBaseImages()
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if r == ref {
+			return nil
+		}
+	}
+	return i.setBaseImages(append(refs, ref))
+}
+
+// RemoveBaseImage removes the base image with the given reference.
+func (i *Image) RemoveBaseImage(ref string) error {
+	refs, err := i.GetBaseImages()
+	if err != nil {
+		return err
+	}
+	for j, r := range refs {
+		if r == ref {
+			return i.setBaseImages(append(refs[:j], refs[j+1:]...))
+		}
+	}
+	return ErrNotFound
+}
+
+func (i *Image) setBaseImages(refs []string) error {
+	if len(refs) == 0 {
+		delete(i.manifest.Annotations, BaseImagesAnnotation)
+		return i.save()
+	}
+	blob, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	i.addAnnotationSaveless(BaseImagesAnnotation, string(blob))
+	return i.save()
+}
+
+// Flatten returns the config and manifest this image would have with the
+// given layers placed underneath its own, and without any base images
+// recorded. The image itself is not modified.
+func (i *Image) Flatten(layers []ociImage.Descriptor, diffIDs []string) (ociImage.Image, ociImage.Manifest) {
+	config := i.config
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(append([]string{}, diffIDs...), i.config.RootFS.DiffIDs...)
+
+	manifest := i.manifest
+	manifest.Layers = append(append([]ociImage.Descriptor{}, layers...), i.manifest.Layers...)
+	manifest.Annotations = make(map[string]string)
+	for k, v := range i.manifest.Annotations {
+		if k != BaseImagesAnnotation {
+			manifest.Annotations[k] = v
+		}
+	}
+	if len(manifest.Annotations) == 0 {
+		manifest.Annotations = nil
+	}
+	return config, manifest
+}
+
+// GetRefName returns the name of the ref this image was loaded from.
+func (i *Image) GetRefName() string {
+	return i.refName
+}
@@ -0,0 +1,229 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rkt/rkt/pkg/group"
+	"github.com/rkt/rkt/pkg/passwd"
+)
+
+// owner is the user and group that own a file, either of which may be -1 to
+// leave it unchanged.
+type owner struct {
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+}
+
+// applyCopyOptions applies the mode and owner in opts to target, and
+// everything under it, in the image filesystem at root.
+func (a *ACBuild) applyCopyOptions(root, target string, opts CopyOptions) error {
+	uid, gid := -1, -1
+	if opts.Chown != "" {
+		var err error
+		uid, gid, err = a.resolveOwner(opts.Chown, opts.Insecure)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Chmod != 0 {
+		err := filepath.Walk(target, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.Mode()&os.ModeSymlink != 0 {
+				return err
+			}
+			return os.Chmod(p, opts.Chmod)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return a.setOwner(root, target, uid, gid)
+}
+
+// resolveOwner parses an owner of the form USER[:GROUP], looking up names in
+// the image's /etc/passwd and /etc/group.
+func (a *ACBuild) resolveOwner(chown string, insecure bool) (int, int, error) {
+	userName, groupName := chown, ""
+	hasGroup := false
+	if i := strings.Index(chown, ":"); i != -1 {
+		userName, groupName, hasGroup = chown[:i], chown[i+1:], true
+	}
+	if userName == "" || (hasGroup && groupName == "") {
+		return -1, -1, fmt.Errorf("invalid owner %q, expected USER[:GROUP]", chown)
+	}
+
+	uid, uidErr := strconv.Atoi(userName)
+	gid, gidErr := strconv.Atoi(groupName)
+	if !hasGroup {
+		gidErr = nil
+	}
+	if uidErr == nil && gidErr == nil {
+		if !hasGroup {
+			gid = uid
+		}
+		return uid, gid, nil
+	}
+
+	etcDir, err := ioutil.TempDir(a.ContextPath, "owner-")
+	if err != nil {
+		return -1, -1, err
+	}
+	defer os.RemoveAll(etcDir)
+	layers, err := a.layerPaths(insecure)
+	if err != nil {
+		return -1, -1, err
+	}
+	lookup := func(name, file string, find func(name, path string) (int, error)) (int, error) {
+		staged := path.Join(etcDir, path.Base(file))
+		if err := stageLayeredPath(layers, file, staged); err != nil {
+			return -1, fmt.Errorf("can't look up %q: %v", name, err)
+		}
+		id, err := find(name, staged)
+		if err != nil {
+			return -1, fmt.Errorf("can't look up %q in %s: %v", name, file, err)
+		}
+		return id, nil
+	}
+
+	if uidErr != nil {
+		uid, err = lookup(userName, "/etc/passwd", passwd.LookupUidFromFile)
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+	switch {
+	case !hasGroup:
+		gid = uid
+	case gidErr != nil:
+		gid, err = lookup(groupName, "/etc/group", group.LookupGidFromFile)
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// setOwner makes target, and everything under it, in the image filesystem at
+// root owned by uid and gid. Without root privileges files can't be chowned,
+// so the owners are recorded instead and applied to the files' tar headers
+// when the image or layer is written. Passing -1 for both forgets any owners
+// recorded for target.
+func (a *ACBuild) setOwner(root, target string, uid, gid int) error {
+	if os.Geteuid() == 0 {
+		if uid == -1 && gid == -1 {
+			return nil
+		}
+		return filepath.Walk(target, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(p, uid, gid)
+		})
+	}
+
+	owners, err := a.loadOwners()
+	if err != nil {
+		return err
+	}
+	if owners == nil && uid == -1 && gid == -1 {
+		return nil
+	}
+	if owners == nil {
+		owners = make(map[string]owner)
+	}
+
+	rel := imagePath(root, target)
+	for p := range owners {
+		if p == rel || strings.HasPrefix(p, rel+"/") {
+			delete(owners, p)
+		}
+	}
+	if uid != -1 || gid != -1 {
+		err := filepath.Walk(target, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			owners[imagePath(root, p)] = owner{uid, gid}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	blob, err := json.Marshal(owners)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.OwnersPath, blob, 0644)
+}
+
+// loadOwners returns the owners recorded by setOwner, keyed by their path in
+// the image, or nil if there aren't any.
+func (a *ACBuild) loadOwners() (map[string]owner, error) {
+	blob, err := ioutil.ReadFile(a.OwnersPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var owners map[string]owner
+	err = json.Unmarshal(blob, &owners)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", a.OwnersPath, err)
+	}
+	return owners, nil
+}
+
+// ownerEditor returns a function that sets the owners recorded by setOwner
+// in tar headers, whose names are relative to the root of the image
+// filesystem once prefix is removed.
+func ownerEditor(owners map[string]owner, prefix string) func(*tar.Header) {
+	return func(hdr *tar.Header) {
+		name := path.Clean(hdr.Name)
+		if prefix != "" {
+			if name != prefix && !strings.HasPrefix(name, prefix+"/") {
+				return
+			}
+			name = strings.TrimPrefix(name, prefix)
+		}
+		o, ok := owners[path.Clean("/"+name)]
+		if !ok {
+			return
+		}
+		if o.Uid != -1 {
+			hdr.Uid, hdr.Uname = o.Uid, ""
+		}
+		if o.Gid != -1 {
+			hdr.Gid, hdr.Gname = o.Gid, ""
+		}
+	}
+}
+
+// imagePath returns the absolute path in the image of p, which is in the image
+// filesystem at root.
+func imagePath(root, p string) string {
+	return path.Clean("/" + strings.TrimPrefix(path.Clean(p), path.Clean(root)))
+}
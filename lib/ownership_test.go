@@ -0,0 +1,66 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestImagePath(t *testing.T) {
+	tests := []struct {
+		root, p, wanted string
+	}{
+		{"/ctx/rootfs", "/ctx/rootfs", "/"},
+		{"/ctx/rootfs/", "/ctx/rootfs/etc/app", "/etc/app"},
+		{"/ctx/rootfs", "/ctx/rootfs/etc/../usr/bin", "/usr/bin"},
+	}
+	for _, tt := range tests {
+		if got := imagePath(tt.root, tt.p); got != tt.wanted {
+			t.Errorf("imagePath(%q, %q) = %q, wanted %q", tt.root, tt.p, got, tt.wanted)
+		}
+	}
+}
+
+func TestOwnerEditor(t *testing.T) {
+	owners := map[string]owner{
+		"/etc/app":        {Uid: 1000, Gid: 50},
+		"/etc/app/conf":   {Uid: 1000, Gid: -1},
+		"/srv":            {Uid: -1, Gid: 8},
+		"/rootfs/etc/app": {Uid: 1, Gid: 1},
+	}
+	tests := []struct {
+		prefix, name     string
+		uid, gid         int
+		uname, groupName string
+	}{
+		{"", "etc/app/", 1000, 50, "", ""},
+		{"", "./etc/app/conf", 1000, 0, "", "root"},
+		{"", "srv", 0, 8, "root", ""},
+		{"", "usr", 0, 0, "root", "root"},
+		{"rootfs", "rootfs/etc/app", 1000, 50, "", ""},
+		{"rootfs", "rootfs", 0, 0, "root", "root"},
+		{"rootfs", "manifest", 0, 0, "root", "root"},
+	}
+	for _, tt := range tests {
+		hdr := &tar.Header{Name: tt.name, Uname: "root", Gname: "root"}
+		ownerEditor(owners, tt.prefix)(hdr)
+		if hdr.Uid != tt.uid || hdr.Gid != tt.gid || hdr.Uname != tt.uname || hdr.Gname != tt.groupName {
+			t.Errorf("%q with prefix %q: got %d:%d (%q:%q), wanted %d:%d (%q:%q)",
+				tt.name, tt.prefix, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname,
+				tt.uid, tt.gid, tt.uname, tt.groupName)
+		}
+	}
+}
@@ -93,7 +93,7 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 	var depPaths []string
 	switch a.Mode {
 	case BuildModeOCI:
-		depPaths, err = a.generateOverlayPathsOCI()
+		depPaths, err = a.generateOverlayPathsOCI(insecure)
 	case BuildModeAppC:
 		depPaths, err = a.generateOverlayPathsAppC(insecure)
 	default:
@@ -177,7 +177,7 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 }
 
 func (a *ACBuild) generateOverlayPathsAppC(insecure bool) ([]string, error) {
-	deps, err := a.renderACI(insecure, a.Debug)
+	deps, err := a.renderACI(insecure)
 	if err != nil {
 		return nil, err
 	}
@@ -190,7 +190,7 @@ func (a *ACBuild) generateOverlayPathsAppC(insecure bool) ([]string, error) {
 	return deps, nil
 }
 
-func (a *ACBuild) generateOverlayPathsOCI() ([]string, error) {
+func (a *ACBuild) generateOverlayPathsOCI(insecure bool) ([]string, error) {
 	var layerDigests []string
 	switch ociMan := a.man.(type) {
 	case *oci.Image:
@@ -219,7 +219,12 @@ func (a *ACBuild) generateOverlayPathsOCI() ([]string, error) {
 			layerPaths = append(layerPaths, path.Join(a.OCIExpandedBlobsPath, algo, hash))
 		}
 	}
-	return layerPaths, nil
+
+	basePaths, err := a.generateOverlayPathsBaseImages(insecure)
+	if err != nil {
+		return nil, err
+	}
+	return append(basePaths, layerPaths...), nil
 }
 
 func (a *ACBuild) getEnvVarsAppC() (map[string]string, error) {
@@ -280,13 +285,21 @@ func supportsOverlay() bool {
 	return false
 }
 
-func (a *ACBuild) renderACI(insecure, debug bool) ([]string, error) {
-	reg := registry.Registry{
+// depRegistry returns a registry backed by the build context's dependency
+// store.
+func (a *ACBuild) depRegistry(insecure bool) registry.Registry {
+	return registry.Registry{
 		DepStoreTarPath:      a.DepStoreTarPath,
 		DepStoreExpandedPath: a.DepStoreExpandedPath,
 		Insecure:             insecure,
-		Debug:                debug,
+		Debug:                a.Debug,
+		Retries:              a.FetchRetries,
+		Timeout:              a.FetchTimeout,
 	}
+}
+
+func (a *ACBuild) renderACI(insecure bool) ([]string, error) {
+	reg := a.depRegistry(insecure)
 
 	man, err := util.GetManifest(a.CurrentImagePath)
 	if err != nil {
@@ -297,18 +310,35 @@ func (a *ACBuild) renderACI(insecure, debug bool) ([]string, error) {
 		return nil, nil
 	}
 
+	err = reg.FetchDeps(man.Dependencies)
+	if derr, ok := err.(*registry.DependencyError); ok && derr.Err == registry.ErrNotFound {
+		dep := derr.Dependency
+		l, _ := dep.Labels.Get("version")
+		return nil, fmt.Errorf("dependency %q doesn't appear to exist: %v", string(dep.ImageName)+":"+l, derr.Err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Catch anything that would make rendering fail part of the way through
+	// before starting.
+	err = checkDependencyGraph(reg, man)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.checkDependencyLock(man, reg, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = reg.RenderDeps(man.Dependencies)
+	if err != nil {
+		return nil, err
+	}
+
 	var deplist []string
 	for _, dep := range man.Dependencies {
-		err := reg.FetchAndRender(dep.ImageName, dep.Labels, dep.Size)
-		switch err {
-		case nil:
-		case registry.ErrNotFound:
-			l, _ := dep.Labels.Get("version")
-			return nil, fmt.Errorf("dependency %q doesn't appear to exist: %v", string(dep.ImageName)+":"+l, err)
-		default:
-			return nil, err
-		}
-
 		depkey, err := reg.GetACI(dep.ImageName, dep.Labels)
 		if err != nil {
 			return nil, err
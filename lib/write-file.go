@@ -0,0 +1,93 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/appc/spec/aci"
+)
+
+// WriteFile writes contents to the file at p in the current build, replacing
+// anything already there and creating its parent directories. The file is
+// given the mode perm, and is owned by uid and gid unless they're -1. In OCI
+// builds the file is written to the top layer.
+func (a *ACBuild) WriteFile(p string, contents []byte, perm os.FileMode, uid, gid int) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	switch a.Mode {
+	case BuildModeAppC:
+		return a.writeFileInRoot(path.Join(a.CurrentImagePath, aci.RootfsDir), p, contents, perm, uid, gid)
+	case BuildModeOCI:
+		currentLayer, err := a.expandTopOCILayer()
+		if err != nil {
+			return err
+		}
+		err = a.writeFileInRoot(currentLayer, p, contents, perm, uid, gid)
+		if err != nil {
+			return err
+		}
+		return a.rehashAndStoreOCIBlob(currentLayer, false)
+	}
+	return fmt.Errorf("unknown build mode: %s", a.Mode)
+}
+
+func (a *ACBuild) writeFileInRoot(root, p string, contents []byte, perm os.FileMode, uid, gid int) error {
+	target := path.Join(root, path.Clean("/"+p))
+	if target == path.Clean(root) {
+		return fmt.Errorf("can't write a file to /")
+	}
+
+	err := os.MkdirAll(path.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	// Remove whatever is there first, so that a symlink can't redirect the
+	// write outside of the image.
+	info, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case info.IsDir():
+		return fmt.Errorf("%s is a directory", p)
+	default:
+		err = os.Remove(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(target, contents, perm)
+	if err != nil {
+		return err
+	}
+	// The mode given to WriteFile is subject to the umask.
+	err = os.Chmod(target, perm)
+	if err != nil {
+		return err
+	}
+	return a.setOwner(root, target, uid, gid)
+}
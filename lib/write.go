@@ -57,6 +57,11 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		if man.Name == types.ACIdentifier(placeholdername) {
 			return "", fmt.Errorf("can't write ACI, name was never set")
 		}
+
+		err = a.checkDependencyLock(man, a.depRegistry(false), false)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	fileFlags := os.O_CREATE | os.O_WRONLY
@@ -108,9 +113,32 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		if err != nil {
 			return "", err
 		}
+		owners, err := a.loadOwners()
+		if err != nil {
+			return "", err
+		}
+		var editHeader func(*tar.Header)
+		if owners != nil {
+			editHeader = ownerEditor(owners, aci.RootfsDir)
+		}
+		// The walker doesn't read extended attributes, so they're added to
+		// each header here.
+		var xattrErr error
+		cb := func(hdr *tar.Header) bool {
+			if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink && xattrErr == nil {
+				hdr.Xattrs, xattrErr = util.ReadXattrs(path.Join(a.CurrentImagePath, hdr.Name))
+			}
+			if editHeader != nil {
+				editHeader(hdr)
+			}
+			return true
+		}
 		aw := aci.NewImageWriter(*man, twriter)
-		err = filepath.Walk(a.CurrentImagePath, aci.BuildWalker(a.CurrentImagePath, aw, nil))
+		err = filepath.Walk(a.CurrentImagePath, aci.BuildWalker(a.CurrentImagePath, aw, cb))
 		defer aw.Close()
+		if err == nil {
+			err = xattrErr
+		}
 		if err != nil {
 			pathErr, ok := err.(*os.PathError)
 			if !ok {
@@ -128,7 +156,14 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		}
 		aw.Close()
 	case BuildModeOCI:
-		err = filepath.Walk(a.CurrentImagePath, util.PathWalker(twriter, a.CurrentImagePath))
+		imagePath, err := a.flattenBaseImages()
+		if err != nil {
+			return "", err
+		}
+		if imagePath != a.CurrentImagePath {
+			defer os.RemoveAll(imagePath)
+		}
+		err = filepath.Walk(imagePath, util.PathWalker(twriter, imagePath))
 		if err != nil {
 			return "", err
 		}
@@ -0,0 +1,388 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/ioprogress"
+)
+
+const (
+	// DefaultRetries is the number of times a failed download is retried
+	// when Registry.Retries is not set.
+	DefaultRetries = 3
+
+	// DefaultTimeout is used for Registry.Timeout when it is not set.
+	DefaultTimeout = 30 * time.Second
+)
+
+var (
+	// initialBackoff is how long to wait before the first retry of a failed
+	// download. It doubles for each subsequent retry.
+	initialBackoff = time.Second
+
+	errNotModified = fmt.Errorf("resource not modified")
+)
+
+// statusError is returned when a server responds with an unexpected HTTP
+// status code.
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("bad HTTP status code: %d", e.code)
+}
+
+// temporary returns whether a download that failed with err is worth
+// retrying.
+func temporary(err error) bool {
+	switch err := err.(type) {
+	case statusError:
+		return err.code >= 500 || err.code == http.StatusTooManyRequests ||
+			err.code == http.StatusRequestedRangeNotSatisfiable
+	case net.Error, *transferError:
+		return true
+	}
+	return false
+}
+
+func (r Registry) retries() int {
+	switch {
+	case r.Retries < 0:
+		return 0
+	case r.Retries == 0:
+		return DefaultRetries
+	}
+	return r.Retries
+}
+
+func (r Registry) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return r.Timeout
+}
+
+// partialPath returns the path a download of url is stored at until it
+// completes. The path is the same every time for a given url, so a download
+// that was interrupted can be resumed by a later attempt.
+func (r Registry) partialPath(url string) string {
+	return path.Join(r.DepStoreTarPath, fmt.Sprintf("partial-%x", sha256.Sum256([]byte(url))))
+}
+
+// cacheEntry records the ETag an image was served with, so that the next
+// fetch of the same URL can be revalidated instead of downloaded again.
+type cacheEntry struct {
+	ETag    string `json:"etag"`
+	ImageID string `json:"imageID"`
+	Size    uint   `json:"size"`
+}
+
+func (r Registry) cacheEntryPath(url string) string {
+	return path.Join(r.DepStoreTarPath, fmt.Sprintf("cache-%x", sha256.Sum256([]byte(url))))
+}
+
+// getCacheEntry returns the cache entry for url, or nil if there is none or
+// the image it refers to is no longer in the store.
+func (r Registry) getCacheEntry(url string) *cacheEntry {
+	blob, err := ioutil.ReadFile(r.cacheEntryPath(url))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(blob, &entry); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(path.Join(r.DepStoreTarPath, entry.ImageID)); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+func (r Registry) putCacheEntry(url string, entry cacheEntry) error {
+	if entry.ETag == "" {
+		return nil
+	}
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.cacheEntryPath(url), blob, 0644)
+}
+
+// download fetches url into the file at path, and returns the ETag the server
+// sent with it. If a previous attempt left part of the file at path, the
+// download is resumed with an HTTP range request. Failed attempts are retried
+// with an exponential backoff. If etag is set it is sent in an If-None-Match
+// header, and errNotModified is returned if the server reports the resource
+// hasn't changed.
+func (r Registry) download(url, path, label, etag string, progress io.Writer) (string, error) {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		newEtag, err := r.downloadOnce(url, path, label, etag, progress)
+		if err == nil || !temporary(err) || attempt >= r.retries() {
+			return newEtag, err
+		}
+		fmt.Fprintf(progress, "Error downloading %s, retrying in %v: %v\n", label, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// DownloadFile fetches the file at url into path, with the same retries,
+// timeouts, proxy and TLS settings as images, and reports its progress to
+// progress.
+func (r Registry) DownloadFile(url, path string, progress io.Writer) error {
+	_, err := r.download(url, path, url, "", progress)
+	os.Remove(path + ".etag")
+	if err == ErrNotFound {
+		return fmt.Errorf("%s: %v", url, statusError{http.StatusNotFound})
+	}
+	return err
+}
+
+func (r Registry) downloadOnce(url, path, label, etag string, progress io.Writer) (string, error) {
+	//TODO: auth
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// A partial download can only be resumed if we know which version of the
+	// resource it came from, otherwise we start over.
+	var offset int64
+	partialEtag, _ := ioutil.ReadFile(path + ".etag")
+	if finfo, err := os.Stat(path); err == nil && len(partialEtag) != 0 {
+		offset = finfo.Size()
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(partialEtag))
+	} else if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	timeout := r.timeout()
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	if r.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client := &http.Client{Transport: transport}
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("too many redirects")
+		}
+		return nil
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch res.StatusCode {
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return "", fmt.Errorf("unexpected Content-Range resuming %s: %q", label, res.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusNotModified:
+		return etag, errNotModified
+	case http.StatusNotFound:
+		return "", ErrNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Whatever we have on disk doesn't fit the resource any more, so
+		// throw it away and try again from the start.
+		os.Remove(path)
+		os.Remove(path + ".etag")
+		return "", statusError{res.StatusCode}
+	default:
+		return "", statusError{res.StatusCode}
+	}
+
+	newEtag := res.Header.Get("ETag")
+	if newEtag == "" && offset > 0 {
+		newEtag = string(partialEtag)
+	}
+	if offset == 0 {
+		os.Remove(path + ".etag")
+		if newEtag != "" {
+			err = ioutil.WriteFile(path+".etag", []byte(newEtag), 0644)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	out, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	body := newStallReader(res.Body, timeout)
+	defer body.Stop()
+
+	if offset > 0 {
+		label = fmt.Sprintf("%s (resuming at %s)", label, ioprogress.ByteUnitStr(offset))
+	}
+	reader := newIoprogress(label, res.ContentLength, body, progress)
+
+	_, err = io.Copy(out, reader)
+	if err != nil {
+		if body.stalled() {
+			err = &stallError{timeout}
+		}
+		return "", &transferError{label, err}
+	}
+
+	err = out.Sync()
+	if err != nil {
+		return "", fmt.Errorf("error writing %s: %v", label, err)
+	}
+
+	err = out.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return newEtag, nil
+}
+
+// transferError is returned when a download fails part of the way through.
+// What was received so far is kept, so the download can be resumed.
+type transferError struct {
+	label string
+	err   error
+}
+
+func (e *transferError) Error() string {
+	return fmt.Sprintf("error copying %s: %v", e.label, e.err)
+}
+
+// stallError is returned when a download receives no data for longer than the
+// configured timeout.
+type stallError struct {
+	timeout time.Duration
+}
+
+func (e *stallError) Error() string {
+	return fmt.Sprintf("no data received for %v", e.timeout)
+}
+
+// stallReader closes the underlying body if no data has been read from it for
+// longer than timeout, which makes a hung download fail instead of blocking
+// forever.
+type stallReader struct {
+	rc    io.ReadCloser
+	timer *time.Timer
+
+	timeout time.Duration
+	mu      sync.Mutex
+	fired   bool
+}
+
+func newStallReader(rc io.ReadCloser, timeout time.Duration) *stallReader {
+	s := &stallReader{rc: rc, timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.fired = true
+		s.mu.Unlock()
+		rc.Close()
+	})
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.rc.Read(p)
+	s.timer.Reset(s.timeout)
+	return n, err
+}
+
+func (s *stallReader) Stop() {
+	s.timer.Stop()
+}
+
+func (s *stallReader) stalled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fired
+}
+
+func newIoprogress(label string, size int64, rdr io.Reader, w io.Writer) io.Reader {
+	prefix := "Downloading " + label
+	fmtBytesSize := 18
+
+	// if barSize < 2, drawing the bar will panic; 3 will at least give a spinny
+	// thing.
+	barSize := int64(80 - len(prefix) - fmtBytesSize)
+	if barSize < 2 {
+		barSize = 2
+	}
+
+	bar := ioprogress.DrawTextFormatBarForW(barSize, w)
+	fmtfunc := func(progress, total int64) string {
+		// Content-Length is set to -1 when unknown.
+		if total == -1 {
+			return fmt.Sprintf(
+				"%s: %v of an unknown total size",
+				prefix,
+				ioprogress.ByteUnitStr(progress),
+			)
+		}
+		return fmt.Sprintf(
+			"%s: %s %s",
+			prefix,
+			bar(progress, total),
+			ioprogress.DrawTextFormatBytes(progress, total),
+		)
+	}
+
+	return &ioprogress.Reader{
+		Reader:       rdr,
+		Size:         size,
+		DrawFunc:     ioprogress.DrawTerminalf(w, fmtfunc),
+		DrawInterval: time.Second,
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testETag = `"v1"`
+
+var testContent = []byte(strings.Repeat("acbuild", 1024))
+
+func newTestRegistry(t *testing.T) (Registry, func()) {
+	dir, err := ioutil.TempDir("", "acbuild-registry-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	return Registry{
+		DepStoreTarPath: dir,
+		Retries:         2,
+		Timeout:         5 * time.Second,
+	}, func() { os.RemoveAll(dir) }
+}
+
+func serveTestContent(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("If-None-Match") == testETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", testETag)
+	http.ServeContent(w, req, "test.aci", time.Time{}, bytes.NewReader(testContent))
+}
+
+func TestDownloadResumesPartialFile(t *testing.T) {
+	var gotRange string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotRange = req.Header.Get("Range")
+		serveTestContent(w, req)
+	}))
+	defer srv.Close()
+
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	dst := path.Join(r.DepStoreTarPath, "partial")
+	if err := ioutil.WriteFile(dst, testContent[:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst+".etag", []byte(testETag), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	etag, err := r.download(srv.URL, dst, "test", "", ioutil.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if etag != testETag {
+		t.Errorf("etag, expected:%s actual:%s", testETag, etag)
+	}
+	if gotRange != "bytes=100-" {
+		t.Errorf("range, expected:%q actual:%q", "bytes=100-", gotRange)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, testContent) {
+		t.Errorf("resumed file doesn't match, got %d bytes", len(got))
+	}
+}
+
+func TestDownloadRetriesServerErrors(t *testing.T) {
+	failures := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		serveTestContent(w, req)
+	}))
+	defer srv.Close()
+
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	defer func(b time.Duration) { initialBackoff = b }(initialBackoff)
+	initialBackoff = time.Millisecond
+
+	dst := path.Join(r.DepStoreTarPath, "partial")
+	_, err := r.download(srv.URL, dst, "test", "", ioutil.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, testContent) {
+		t.Errorf("downloaded file doesn't match, got %d bytes", len(got))
+	}
+}
+
+func TestDownloadDoesNotRetryNotFound(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		http.NotFound(w, req)
+	}))
+	defer srv.Close()
+
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	_, err := r.download(srv.URL, path.Join(r.DepStoreTarPath, "partial"), "test", "", ioutil.Discard)
+	if err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestDownloadRevalidatesETag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(serveTestContent))
+	defer srv.Close()
+
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	_, err := r.download(srv.URL, path.Join(r.DepStoreTarPath, "partial"), "test", testETag, ioutil.Discard)
+	if err != errNotModified {
+		t.Errorf("expected %v, got %v", errNotModified, err)
+	}
+}
@@ -19,199 +19,403 @@ import (
 	"compress/bzip2"
 	"compress/gzip"
 	"crypto/sha512"
-	"crypto/tls"
 	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"os"
 	"path"
 	"runtime"
-	"time"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/appc/spec/aci"
 	"github.com/appc/spec/discovery"
 	"github.com/appc/spec/pkg/acirenderer"
 	"github.com/appc/spec/schema/types"
-	"github.com/coreos/ioprogress"
 	"xi2.org/x/xz"
 
 	"github.com/containers/build/util"
 )
 
-func (r Registry) tmppath() string {
-	return path.Join(r.DepStoreTarPath, "tmp.aci")
-}
-
-func (r Registry) tmpuncompressedpath() string {
-	return path.Join(r.DepStoreTarPath, "tmp.uncompressed.aci")
-}
-
 // Fetch will download the given image, and optionally its dependencies, into
 // r.DepStoreTarPath
 func (r Registry) Fetch(imagename types.ACIdentifier, labels types.Labels, size uint, fetchDeps bool) error {
-	_, err := r.GetACI(imagename, labels)
-	if err == ErrNotFound {
-		err := r.fetchACIWithSize(imagename, labels, size, fetchDeps)
-		if err != nil {
-			return err
-		}
-		return nil
+	f := r.newFetcher()
+	err := f.fetch(imagename, labels, size, fetchDeps)
+	if err != nil {
+		return err
 	}
-	return err
+	return f.checkIDs()
 }
 
 // FetchAndRender will fetch the given image and all of its dependencies if
 // they have not been fetched yet, and will then render them on to the
 // filesystem if they have not been rendered yet.
 func (r Registry) FetchAndRender(imagename types.ACIdentifier, labels types.Labels, size uint) error {
-	err := r.Fetch(imagename, labels, size, true)
+	f := r.newFetcher()
+	err := f.fetch(imagename, labels, size, true)
 	if err != nil {
 		return err
 	}
-
-	filesToRender, err := acirenderer.GetRenderedACI(imagename,
-		labels, r)
+	err = f.checkIDs()
 	if err != nil {
 		return err
 	}
+	return f.render([]types.Dependency{{ImageName: imagename, Labels: labels}})
+}
+
+// RenderDeps renders every image needed by the given dependencies on to the
+// filesystem, skipping images that have already been rendered. The
+// dependencies must have already been fetched, see FetchDeps.
+func (r Registry) RenderDeps(deps types.Dependencies) error {
+	return r.newFetcher().render(deps)
+}
+
+// RenderedFiles returns the files from each image needed by dep that will be
+// present once it is rendered, keyed by image.
+func (r Registry) RenderedFiles(dep types.Dependency) (map[string]map[string]struct{}, error) {
+	files, err := acirenderer.GetRenderedACI(dep.ImageName, dep.Labels, r)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]map[string]struct{})
+	for _, fs := range files {
+		ret[fs.Key] = fs.FileMap
+	}
+	return ret, nil
+}
 
-filesloop:
-	for _, fs := range filesToRender {
-		_, err := os.Stat(path.Join(r.DepStoreExpandedPath, fs.Key, "rendered"))
-		switch {
-		case os.IsNotExist(err):
-			break
-		case err != nil:
-			return err
-		default:
-			// This ACI has already been rendered
-			continue filesloop
+// FetchDeps will fetch every dependency in deps, along with their own
+// dependencies. Independent images are downloaded and uncompressed
+// concurrently, with at most r.Jobs of them being worked on at once. If
+// fetching one of the given dependencies fails, the returned error is a
+// *DependencyError.
+func (r Registry) FetchDeps(deps types.Dependencies) error {
+	return r.newFetcher().fetchDeps(deps)
+}
+
+func (f *fetcher) fetchDeps(deps types.Dependencies) error {
+	err := each(len(deps), func(i int) error {
+		dep := deps[i]
+		err := f.fetch(dep.ImageName, dep.Labels, dep.Size, true)
+		if err != nil {
+			return &DependencyError{Dependency: dep, Err: err}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return f.checkIDs()
+}
+
+// DependencyError is returned by FetchDeps when one of the dependencies it was
+// given couldn't be fetched.
+type DependencyError struct {
+	Dependency types.Dependency
+	Err        error
+}
+
+func (e *DependencyError) Error() string {
+	return fmt.Sprintf("error fetching dependency %q: %v", e.Dependency.ImageName, e.Err)
+}
 
-		err = util.ExtractImage(path.Join(r.DepStoreTarPath, fs.Key),
-			path.Join(r.DepStoreExpandedPath, fs.Key), fs.FileMap)
+func (f *fetcher) fetch(imagename types.ACIdentifier, labels types.Labels, size uint, fetchDeps bool) error {
+	_, err := f.r.GetACI(imagename, labels)
+	if err != ErrNotFound {
+		return err
+	}
+	return f.fetchACIWithSize(imagename, labels, size, nil, fetchDeps)
+}
+
+func (f *fetcher) render(deps []types.Dependency) error {
+	var filesToRender acirenderer.RenderedACI
+	seen := make(map[string]struct{})
+	for _, dep := range deps {
+		files, err := acirenderer.GetRenderedACI(dep.ImageName, dep.Labels, f.r)
 		if err != nil {
 			return err
 		}
+		for _, fs := range files {
+			if _, ok := seen[fs.Key]; ok {
+				continue
+			}
+			seen[fs.Key] = struct{}{}
+			filesToRender = append(filesToRender, fs)
+		}
+	}
+
+	return each(len(filesToRender), func(i int) error {
+		f.acquire()
+		defer f.release()
+		return f.r.renderACI(filesToRender[i])
+	})
+}
+
+func (r Registry) renderACI(fs *acirenderer.ACIFiles) error {
+	_, err := os.Stat(path.Join(r.DepStoreExpandedPath, fs.Key, "rendered"))
+	switch {
+	case os.IsNotExist(err):
+		break
+	case err != nil:
+		return err
+	default:
+		// This ACI has already been rendered
+		return nil
+	}
+
+	err = util.ExtractImage(path.Join(r.DepStoreTarPath, fs.Key),
+		path.Join(r.DepStoreExpandedPath, fs.Key), fs.FileMap)
+	if err != nil {
+		return err
+	}
+
+	rfile, err := os.Create(
+		path.Join(r.DepStoreExpandedPath, fs.Key, "rendered"))
+	if err != nil {
+		return err
+	}
+	return rfile.Close()
+}
 
-		rfile, err := os.Create(
-			path.Join(r.DepStoreExpandedPath, fs.Key, "rendered"))
+// checkIDs verifies that every dependency which specified an image ID
+// resolved to that image. It must only be called once all fetches have
+// finished.
+func (f *fetcher) checkIDs() error {
+	f.mu.Lock()
+	checks := f.idChecks
+	f.idChecks = nil
+	f.mu.Unlock()
+
+	for _, dep := range checks {
+		id, err := f.r.GetACI(dep.ImageName, dep.Labels)
 		if err != nil {
 			return err
 		}
-		rfile.Close()
+		if !idMatches(id, dep.ImageID) {
+			return fmt.Errorf("dependency %s doesn't match hash",
+				dep.ImageName)
+		}
 	}
 	return nil
 }
 
-func (r Registry) fetchACIWithSize(imagename types.ACIdentifier, labels types.Labels, size uint, fetchDeps bool) error {
-	endpoint, err := r.discoverEndpoint(imagename, labels)
+// fetchACIWithSize downloads the given image, and if fetchDeps is set, all of
+// its dependencies. Dependencies are fetched concurrently. An image that
+// another call has already claimed is skipped, as that call is responsible
+// for it and for its dependencies.
+func (f *fetcher) fetchACIWithSize(imagename types.ACIdentifier, labels types.Labels, size uint, imageID *types.Hash, fetchDeps bool) error {
+	if !f.claim(imagename, labels) {
+		return nil
+	}
+
+	f.acquire()
+	id, err := f.downloadACI(imagename, labels, size, imageID, fetchDeps)
+	f.release()
 	if err != nil {
 		return err
 	}
 
-	err = r.download(endpoint.ACI, r.tmppath(), string(imagename))
+	if !fetchDeps {
+		return nil
+	}
+
+	man, err := f.r.GetImageManifest(id)
 	if err != nil {
 		return err
 	}
 
-	//TODO: download .asc, verify the .aci with it
+	if man.Name != imagename {
+		return fmt.Errorf(
+			"downloaded ACI name %q does not match expected image name %q",
+			man.Name, imagename)
+	}
 
-	if size != 0 {
-		finfo, err := os.Stat(r.tmppath())
+	return each(len(man.Dependencies), func(i int) error {
+		dep := man.Dependencies[i]
+		err := f.fetchACIWithSize(dep.ImageName, dep.Labels, dep.Size, dep.ImageID, fetchDeps)
 		if err != nil {
 			return err
 		}
+		if dep.ImageID != nil {
+			f.addIDCheck(dep)
+		}
+		return nil
+	})
+}
+
+// downloadACI downloads the given image into the store, and returns its image
+// ID. If imageID is set, the downloaded image must match it. If expand is set,
+// the image's manifest is also placed in r.DepStoreExpandedPath so that it can
+// be found by GetACI.
+func (f *fetcher) downloadACI(imagename types.ACIdentifier, labels types.Labels, size uint, imageID *types.Hash, expand bool) (string, error) {
+	r := f.r
+	endpoint, err := r.discoverEndpoint(imagename, labels)
+	if err != nil {
+		return "", err
+	}
+
+	// Downloads are kept under a name derived from their URL until they're
+	// complete, so an interrupted download can be resumed later on.
+	url := endpoint.ACI
+	f.lockURL(url)
+	defer f.unlockURL(url)
+	partialpath := r.partialPath(url)
+
+	var etag string
+	cached := r.getCacheEntry(url)
+	if cached != nil {
+		etag = cached.ETag
+	}
+
+	etag, err = r.download(url, partialpath, string(imagename), etag, f.progress)
+	switch {
+	case err == errNotModified:
+		id := cached.ImageID
+		if imageID != nil && !idMatches(id, imageID) {
+			return "", fmt.Errorf("dependency %s doesn't match hash: expected=%s, actual=%s",
+				imagename, imageID, id)
+		}
+		return id, r.expand(id, cached.Size, expand)
+	case err != nil:
+		return "", err
+	}
+
+	//TODO: download .asc, verify the .aci with it
+
+	finfo, err := os.Stat(partialpath)
+	if err != nil {
+		return "", err
+	}
+	if size != 0 {
 		if finfo.Size() != int64(size) {
-			return fmt.Errorf(
+			os.Remove(partialpath)
+			os.Remove(partialpath + ".etag")
+			return "", fmt.Errorf(
 				"dependency %s has incorrect size: expected=%d, actual=%d",
-				size, finfo.Size())
+				imagename, size, finfo.Size())
 		}
 	}
 
-	err = r.uncompress()
+	// Every download gets its own temporary file, so concurrent downloads
+	// into the same store don't clobber each other.
+	tmpuncompressedpath, err := r.tempFile("tmp.uncompressed.aci")
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer os.Remove(tmpuncompressedpath)
 
-	err = os.Remove(r.tmppath())
+	// The image ID is computed while uncompressing, so a mismatch is caught
+	// before the image ever makes it into the store.
+	id, err := uncompress(partialpath, tmpuncompressedpath)
+	os.Remove(partialpath)
+	os.Remove(partialpath + ".etag")
 	if err != nil {
-		return err
+		return "", err
+	}
+	if imageID != nil && !idMatches(id, imageID) {
+		return "", fmt.Errorf("dependency %s doesn't match hash: expected=%s, actual=%s",
+			imagename, imageID, id)
 	}
 
-	id, err := GenImageID(r.tmpuncompressedpath())
+	err = os.Rename(tmpuncompressedpath, path.Join(r.DepStoreTarPath, id))
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = os.Rename(r.tmpuncompressedpath(), path.Join(r.DepStoreTarPath, id))
+	err = r.putCacheEntry(url, cacheEntry{ETag: etag, ImageID: id, Size: uint(finfo.Size())})
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if !fetchDeps {
+	return id, r.expand(id, uint(finfo.Size()), expand)
+}
+
+// expand places the manifest of the image with the given ID in
+// r.DepStoreExpandedPath, so that it can be found by GetACI, and records the
+// size it was downloaded with. It does nothing if doExpand is false.
+func (r Registry) expand(id string, size uint, doExpand bool) error {
+	if !doExpand {
 		return nil
 	}
 
-	err = os.MkdirAll(
+	err := os.MkdirAll(
 		path.Join(r.DepStoreExpandedPath, id, aci.RootfsDir), 0755)
 	if err != nil {
 		return err
 	}
 
-	err = getManifestFromTar(path.Join(r.DepStoreTarPath, id),
-		path.Join(r.DepStoreExpandedPath, id, aci.ManifestFile))
+	err = ioutil.WriteFile(path.Join(r.DepStoreExpandedPath, id, "size"),
+		[]byte(strconv.FormatUint(uint64(size), 10)), 0644)
 	if err != nil {
 		return err
 	}
 
-	man, err := r.GetImageManifest(id)
+	// The manifest is written under a temporary name and then renamed, so
+	// that a concurrent GetACI never reads a partial manifest.
+	manpath := path.Join(r.DepStoreExpandedPath, id, aci.ManifestFile)
+	err = getManifestFromTar(path.Join(r.DepStoreTarPath, id), manpath+".tmp")
 	if err != nil {
 		return err
 	}
+	return os.Rename(manpath+".tmp", manpath)
+}
 
-	if man.Name != imagename {
-		return fmt.Errorf(
-			"downloaded ACI name %q does not match expected image name %q",
-			man.Name, imagename)
-	}
+// idMatches returns whether id is the image ID described by want, which may
+// be a truncated hash.
+func idMatches(id string, want *types.Hash) bool {
+	return strings.HasPrefix(id, want.String())
+}
 
-	for _, dep := range man.Dependencies {
-		err := r.fetchACIWithSize(dep.ImageName, dep.Labels, dep.Size, fetchDeps)
-		if err != nil {
-			return err
-		}
-		if dep.ImageID != nil {
-			id, err := r.GetACI(dep.ImageName, dep.Labels)
-			if err != nil {
-				return err
-			}
-			if id != dep.ImageID.String() {
-				return fmt.Errorf("dependency %s doesn't match hash",
-					dep.ImageName)
-			}
-		}
+// lockURL makes sure only one download of the given url is in progress at a
+// time, as they'd be written to the same partial file.
+func (f *fetcher) lockURL(url string) {
+	f.mu.Lock()
+	l, ok := f.urlLocks[url]
+	if !ok {
+		l = &sync.Mutex{}
+		f.urlLocks[url] = l
+	}
+	f.mu.Unlock()
+	l.Lock()
+}
+
+func (f *fetcher) unlockURL(url string) {
+	f.mu.Lock()
+	l := f.urlLocks[url]
+	f.mu.Unlock()
+	l.Unlock()
+}
+
+// tempFile creates a new, uniquely named, empty file in r.DepStoreTarPath and
+// returns its path.
+func (r Registry) tempFile(prefix string) (string, error) {
+	tmp, err := ioutil.TempFile(r.DepStoreTarPath, prefix+".")
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return tmp.Name(), tmp.Close()
 }
 
-// Need to uncompress the file to be able to generate the Image ID
-func (r Registry) uncompress() error {
-	acifile, err := os.Open(r.tmppath())
+// uncompress writes the uncompressed contents of the image at src to dst, and
+// returns the resulting image ID.
+func uncompress(src, dst string) (string, error) {
+	acifile, err := os.Open(src)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer acifile.Close()
 
 	typ, err := aci.DetectFileType(acifile)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// In case DetectFileType changed the cursor
 	_, err = acifile.Seek(0, 0)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	var in io.Reader
@@ -219,41 +423,42 @@ func (r Registry) uncompress() error {
 	case aci.TypeGzip:
 		in, err = gzip.NewReader(acifile)
 		if err != nil {
-			return err
+			return "", err
 		}
 	case aci.TypeBzip2:
 		in = bzip2.NewReader(acifile)
 	case aci.TypeXz:
 		in, err = xz.NewReader(acifile, 0)
 		if err != nil {
-			return err
+			return "", err
 		}
 	case aci.TypeTar:
 		in = acifile
 	case aci.TypeText:
-		return fmt.Errorf("downloaded ACI is text, not a tarball")
+		return "", fmt.Errorf("downloaded ACI is text, not a tarball")
 	case aci.TypeUnknown:
-		return fmt.Errorf("downloaded ACI is of an unknown type")
+		return "", fmt.Errorf("downloaded ACI is of an unknown type")
 	}
 
-	out, err := os.OpenFile(r.tmpuncompressedpath(),
+	out, err := os.OpenFile(dst,
 		os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer out.Close()
 
-	_, err = io.Copy(out, in)
+	h := sha512.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
 	if err != nil {
-		return fmt.Errorf("error copying: %v", err)
+		return "", fmt.Errorf("error copying: %v", err)
 	}
 
 	err = out.Sync()
 	if err != nil {
-		return fmt.Errorf("error writing: %v", err)
+		return "", fmt.Errorf("error writing: %v", err)
 	}
 
-	return nil
+	return fmt.Sprintf("%s%x", hashPrefix, h.Sum(nil)), nil
 }
 
 func getManifestFromTar(tarpath, dst string) error {
@@ -353,103 +558,3 @@ func (r Registry) discoverEndpoint(imageName types.ACIdentifier, labels types.La
 
 	return &acis[0], nil
 }
-
-func (r Registry) download(url, path, label string) error {
-	//TODO: auth
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
-	}
-	transport := http.DefaultTransport
-	transport.(*http.Transport).Proxy = http.ProxyFromEnvironment
-	if r.Insecure {
-		transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	}
-
-	client := &http.Client{Transport: transport}
-	//f.setHTTPHeaders(req, etag)
-
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		if len(via) >= 10 {
-			return fmt.Errorf("too many redirects")
-		}
-		//f.setHTTPHeaders(req, etag)
-		return nil
-	}
-
-	res, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-
-	switch res.StatusCode {
-	case http.StatusOK:
-		break
-	case http.StatusNotFound:
-		return ErrNotFound
-	default:
-		return fmt.Errorf("bad HTTP status code: %d", res.StatusCode)
-	}
-
-	out, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-
-	reader := newIoprogress(label, res.ContentLength, res.Body)
-
-	_, err = io.Copy(out, reader)
-	if err != nil {
-		return fmt.Errorf("error copying %s: %v", label, err)
-	}
-
-	err = out.Sync()
-	if err != nil {
-		return fmt.Errorf("error writing %s: %v", label, err)
-	}
-
-	err = out.Close()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func newIoprogress(label string, size int64, rdr io.Reader) io.Reader {
-	prefix := "Downloading " + label
-	fmtBytesSize := 18
-
-	// if barSize < 2, drawing the bar will panic; 3 will at least give a spinny
-	// thing.
-	barSize := int64(80 - len(prefix) - fmtBytesSize)
-	if barSize < 2 {
-		barSize = 2
-	}
-
-	bar := ioprogress.DrawTextFormatBarForW(barSize, os.Stderr)
-	fmtfunc := func(progress, total int64) string {
-		// Content-Length is set to -1 when unknown.
-		if total == -1 {
-			return fmt.Sprintf(
-				"%s: %v of an unknown total size",
-				prefix,
-				ioprogress.ByteUnitStr(progress),
-			)
-		}
-		return fmt.Sprintf(
-			"%s: %s %s",
-			prefix,
-			bar(progress, total),
-			ioprogress.DrawTextFormatBytes(progress, total),
-		)
-	}
-
-	return &ioprogress.Reader{
-		Reader:       rdr,
-		Size:         size,
-		DrawFunc:     ioprogress.DrawTerminalf(os.Stderr, fmtfunc),
-		DrawInterval: time.Second,
-	}
-}
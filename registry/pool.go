@@ -0,0 +1,131 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// DefaultJobs is the number of images that will be downloaded or rendered at
+// once when Registry.Jobs is not set.
+const DefaultJobs = 4
+
+// fetcher coordinates the fetching and rendering of a set of images. The
+// expensive parts of the work (downloading, uncompressing and extracting) are
+// bounded by a semaphore, and each image is only handled once no matter how
+// many times it appears in the dependency graph.
+type fetcher struct {
+	r        Registry
+	sem      chan struct{}
+	progress io.Writer
+
+	mu       sync.Mutex
+	claimed  map[string]struct{}
+	idChecks []types.Dependency
+	urlLocks map[string]*sync.Mutex
+}
+
+func (r Registry) newFetcher() *fetcher {
+	jobs := r.Jobs
+	if jobs <= 0 {
+		jobs = DefaultJobs
+	}
+	var progress io.Writer = os.Stderr
+	if jobs > 1 {
+		// Multiple progress bars redrawn with carriage returns on the same
+		// terminal line are unreadable, so when downloads may overlap each
+		// update is written as a whole line instead.
+		progress = &lockedWriter{w: os.Stderr}
+	}
+	return &fetcher{
+		r:        r,
+		sem:      make(chan struct{}, jobs),
+		progress: progress,
+		claimed:  make(map[string]struct{}),
+		urlLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+func (f *fetcher) acquire() {
+	f.sem <- struct{}{}
+}
+
+func (f *fetcher) release() {
+	<-f.sem
+}
+
+// claim returns true if the caller is the first to ask for the image with the
+// given name and labels, and is therefore responsible for fetching it.
+func (f *fetcher) claim(imagename types.ACIdentifier, labels types.Labels) bool {
+	key := imageKey(imagename, labels)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.claimed[key]; ok {
+		return false
+	}
+	f.claimed[key] = struct{}{}
+	return true
+}
+
+// addIDCheck records a dependency whose image ID must be verified once every
+// fetch has finished.
+func (f *fetcher) addIDCheck(dep types.Dependency) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.idChecks = append(f.idChecks, dep)
+}
+
+func imageKey(imagename types.ACIdentifier, labels types.Labels) string {
+	key := string(imagename)
+	for _, l := range labels {
+		key += "," + string(l.Name) + "=" + l.Value
+	}
+	return key
+}
+
+// each calls fn for every index in [0, n) concurrently, and returns the first
+// error encountered once all calls have returned.
+func each(n int, fn func(int) error) error {
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- fn(i)
+		}(i)
+	}
+	var err error
+	for i := 0; i < n; i++ {
+		if err1 := <-errs; err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// lockedWriter serializes writes to w, so that lines written by concurrent
+// downloads don't interleave.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestEachReturnsFirstError(t *testing.T) {
+	errBoom := fmt.Errorf("boom")
+	var mu sync.Mutex
+	called := make(map[int]bool)
+	err := each(5, func(i int) error {
+		mu.Lock()
+		called[i] = true
+		mu.Unlock()
+		if i == 3 {
+			return errBoom
+		}
+		return nil
+	})
+	if err != errBoom {
+		t.Errorf("expected %v, got %v", errBoom, err)
+	}
+	if len(called) != 5 {
+		t.Errorf("expected 5 calls, got %d", len(called))
+	}
+}
+
+func TestFetcherBoundsJobs(t *testing.T) {
+	f := Registry{Jobs: 2}.newFetcher()
+
+	var mu sync.Mutex
+	var running, max int
+	err := each(10, func(int) error {
+		f.acquire()
+		defer f.release()
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if max > 2 {
+		t.Errorf("expected at most 2 concurrent jobs, got %d", max)
+	}
+}
+
+func TestFetcherClaim(t *testing.T) {
+	f := Registry{}.newFetcher()
+	name := *types.MustACIdentifier("example.com/app")
+	v1 := types.Labels{{Name: *types.MustACIdentifier("version"), Value: "1"}}
+	v2 := types.Labels{{Name: *types.MustACIdentifier("version"), Value: "2"}}
+
+	if !f.claim(name, v1) {
+		t.Errorf("first claim of %s should succeed", imageKey(name, v1))
+	}
+	if f.claim(name, v1) {
+		t.Errorf("second claim of %s should fail", imageKey(name, v1))
+	}
+	if !f.claim(name, v2) {
+		t.Errorf("claim of %s should succeed", imageKey(name, v2))
+	}
+}
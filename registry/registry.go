@@ -28,7 +28,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
@@ -51,6 +53,17 @@ type Registry struct {
 	DepStoreExpandedPath string
 	Insecure             bool
 	Debug                bool
+	// Jobs is the maximum number of images that will be downloaded or
+	// rendered at once. If it is zero, DefaultJobs is used.
+	Jobs int
+	// Retries is the number of times a failed download is retried. If it is
+	// zero, DefaultRetries is used, and if it is negative failed downloads
+	// aren't retried.
+	Retries int
+	// Timeout bounds how long connecting to a server, waiting for its
+	// response, or waiting for more data from it may take. If it is zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
 }
 
 // Read the ACI contents stream given the key. Use ResolveKey to
@@ -100,6 +113,20 @@ func (r Registry) GetImageManifest(key string) (*schema.ImageManifest, error) {
 	return util.GetManifest(path.Join(r.DepStoreExpandedPath, key))
 }
 
+// GetImageSize returns the size the ACI with the given key had when it was
+// downloaded, before being uncompressed.
+func (r Registry) GetImageSize(key string) (uint, error) {
+	blob, err := ioutil.ReadFile(path.Join(r.DepStoreExpandedPath, key, "size"))
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(string(blob)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(size), nil
+}
+
 // Returns the key for the ACI with the given name and labels
 func (r Registry) GetACI(name types.ACIdentifier, labels types.Labels) (string, error) {
 	files, err := ioutil.ReadDir(r.DepStoreExpandedPath)
@@ -109,6 +136,10 @@ func (r Registry) GetACI(name types.ACIdentifier, labels types.Labels) (string,
 nextkey:
 	for _, file := range files {
 		man, err := util.GetManifest(path.Join(r.DepStoreExpandedPath, file.Name()))
+		if os.IsNotExist(err) {
+			// This image is still being fetched
+			continue
+		}
 		if err != nil {
 			return "", err
 		}
@@ -0,0 +1,108 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestBuildSpec(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	for _, dir := range []string{"app", "out"} {
+		err := os.Mkdir(path.Join(workingDir, dir), 0755)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	writeScript(t, workingDir, "app/hello.txt", "hello\n")
+	writeScript(t, workingDir, "app.yaml", `name: example.com/app
+labels:
+  version: "1.0"
+environment:
+  GREETING: hello world
+ports:
+  - name: http
+    port: 8080
+mounts:
+  - name: data
+    path: /data
+user: "1000"
+group: "100"
+exec: [/bin/app, --port, "8080"]
+steps:
+  - copy: {from: app, to: /opt/app}
+outputs: [out/app.aci]
+`)
+
+	_, _, _, err := runACBuild(workingDir, "build", "app.yaml")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	man := readACIManifest(t, path.Join(workingDir, "out", "app.aci"))
+	if man.Name != "example.com/app" {
+		t.Errorf("name is %s, wanted example.com/app", man.Name)
+	}
+	if version, _ := man.Labels.Get("version"); version != "1.0" {
+		t.Errorf("version label is %q, wanted 1.0", version)
+	}
+	app := man.App
+	wantedEnv := types.Environment{{Name: "GREETING", Value: "hello world"}}
+	if !reflect.DeepEqual(app.Environment, wantedEnv) {
+		t.Errorf("environment is %v, wanted %v", app.Environment, wantedEnv)
+	}
+	wantedExec := types.Exec{"/bin/app", "--port", "8080"}
+	if !reflect.DeepEqual(app.Exec, wantedExec) {
+		t.Errorf("exec is %v, wanted %v", app.Exec, wantedExec)
+	}
+	if app.User != "1000" || app.Group != "100" {
+		t.Errorf("user and group are %s:%s, wanted 1000:100", app.User, app.Group)
+	}
+	if len(app.Ports) != 1 || app.Ports[0].Port != 8080 || app.Ports[0].Protocol != "tcp" {
+		t.Errorf("unexpected ports: %v", app.Ports)
+	}
+	if len(app.MountPoints) != 1 || app.MountPoints[0].Path != "/data" {
+		t.Errorf("unexpected mount points: %v", app.MountPoints)
+	}
+}
+
+func TestBuildSpecInvalid(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "app.json", `{"mode": "oci", "name": "example.com/app", "steps": [{}]}`)
+
+	_, _, stderr, err := runACBuild(workingDir, "build", "--check", "app.json")
+	if err == nil {
+		t.Fatalf("invalid spec passed the check")
+	}
+	for _, problem := range []string{
+		"name: only supported in appc builds",
+		"steps[0]: expected exactly one of run, copy and copyToDir",
+		"outputs: at least one output is required",
+	} {
+		if !strings.Contains(stderr, problem) {
+			t.Errorf("%q wasn't reported, got:\n%s", problem, stderr)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/aci"
+)
+
+func mustTarGz(files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, contents := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			panic(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	if err := gw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func mustZip(files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			panic(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCopyURL(t *testing.T) {
+	content := map[string][]byte{
+		"/app.tar.gz": mustTarGz(map[string]string{"bin/app": "app", "etc/app.conf": "conf"}),
+		"/site.zip":   mustZip(map[string]string{"index.html": "index", "css/site.css": "css"}),
+		"/motd":       []byte("hello\n"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, ok := content[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(c)
+	}))
+	defer srv.Close()
+
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	sum := fmt.Sprintf("%x", sha256.Sum256(content["/app.tar.gz"]))
+	steps := [][]string{
+		{"copy", "--extract", "--sha256", sum, srv.URL + "/app.tar.gz", "/opt/app"},
+		{"copy", "--extract", srv.URL + "/site.zip", "/srv/www"},
+		{"copy", srv.URL + "/motd", "/etc/"},
+		{"copy", "--chmod", "0600", srv.URL + "/motd", "/etc/motd.copy"},
+	}
+	for _, args := range steps {
+		if err := runACBuildNoHist(workingDir, args...); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	rootfs := path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir)
+	wanted := map[string]string{
+		"opt/app/bin/app":      "app",
+		"opt/app/etc/app.conf": "conf",
+		"srv/www/index.html":   "index",
+		"srv/www/css/site.css": "css",
+		"etc/motd":             "hello\n",
+		"etc/motd.copy":        "hello\n",
+	}
+	for p, contents := range wanted {
+		actual, err := ioutil.ReadFile(path.Join(rootfs, p))
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		if string(actual) != contents {
+			t.Errorf("%s is %q, wanted %q", p, actual, contents)
+		}
+	}
+
+	failures := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"copy", "--sha256", strings.Repeat("0", 64), srv.URL + "/motd", "/etc/motd"}, "checksum mismatch"},
+		{[]string{"copy", "--extract", srv.URL + "/motd", "/etc"}, "not a tar or zip archive"},
+		{[]string{"copy", srv.URL + "/missing", "/etc/missing"}, "404"},
+		{[]string{"copy", "--extract", "local.tar", "/etc"}, "can only be used with a URL"},
+	}
+	for _, f := range failures {
+		exitCode, _, stderr, _ := runACBuild(workingDir, append([]string{"--no-history"}, f.args...)...)
+		if exitCode == 0 || !strings.Contains(stderr, f.err) {
+			t.Errorf("%v: exit code %d, wanted an error containing %q, got: %s", f.args, exitCode, f.err, stderr)
+		}
+	}
+}
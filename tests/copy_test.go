@@ -21,6 +21,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -276,3 +277,136 @@ func testMatchingFSTree(t *testing.T, workingDir, source, dest string) {
 		t.Fatalf("Got %d changes, expected 0\n%s", len(changes), changestring)
 	}
 }
+
+func TestCopyChownChmod(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	err := os.MkdirAll(path.Join(workingDir, "conf", "sites"), 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = ioutil.WriteFile(path.Join(workingDir, "conf", "sites", "default"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	writeScript(t, workingDir, "build.acb", `begin
+set-name example.com/app
+write-file /etc/passwd <<EOF
+app:x:1000:1000::/home/app:/bin/sh
+EOF
+write-file /etc/group <<EOF
+staff:x:50:
+EOF
+copy --chown app:staff --chmod 0750 conf /etc/app
+copy-to-dir --chown 7:8 conf/sites/default /srv
+write out.aci
+`)
+
+	_, _, _, err = runACBuild(workingDir, "script", "build.acb")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	aciPath := path.Join(workingDir, "out.aci")
+	for _, p := range []string{"etc/app", "etc/app/sites", "etc/app/sites/default"} {
+		hdr, _ := readACIFile(t, aciPath, p)
+		if hdr.Uid != 1000 || hdr.Gid != 50 {
+			t.Errorf("%s is owned by %d:%d, wanted 1000:50", p, hdr.Uid, hdr.Gid)
+		}
+		if hdr.Mode&0777 != 0750 {
+			t.Errorf("%s mode is %o, wanted 750", p, hdr.Mode&0777)
+		}
+	}
+	hdr, _ := readACIFile(t, aciPath, "srv/default")
+	if hdr.Uid != 7 || hdr.Gid != 8 {
+		t.Errorf("srv/default is owned by %d:%d, wanted 7:8", hdr.Uid, hdr.Gid)
+	}
+
+	writeScript(t, workingDir, "bad.acb", `begin
+copy --chown nobody conf /etc/app
+`)
+	exitCode, _, stderr, err := runACBuild(workingDir, "script", "bad.acb")
+	if exitCode == 0 {
+		t.Errorf("unknown user was accepted")
+	} else if !strings.Contains(stderr, `can't look up "nobody"`) {
+		t.Errorf("unexpected error: %s", stderr)
+	}
+}
+
+func TestCopyIgnoreAndGlobs(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	files := map[string]string{
+		".acbuildignore":        "# build outputs\n.git\nbuild/\n*.log\n!keep.log\n",
+		"src/main.go":           "main",
+		"src/pkg/util.go":       "util",
+		"src/pkg/util_test.go":  "test",
+		"src/.git/config":       "git",
+		"src/build/out.bin":     "out",
+		"src/notes.log":         "notes",
+		"src/keep.log":          "keep",
+		"src/vendor/.git/HEAD":  "git",
+		"src/vendor/lib/lib.go": "lib",
+	}
+	for name, contents := range files {
+		p := path.Join(workingDir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	err := runACBuildNoHist(workingDir, "copy", "--exclude", "**/*_test.go", "src", "/src")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = runACBuildNoHist(workingDir, "copy-to-dir", "src/**/*.go", "/gosrc")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = runACBuildNoHist(workingDir, "copy", "src/*.go", "/app/main.go")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	rootfs := path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir)
+	wanted := map[string]bool{
+		"src/main.go":          true,
+		"src/pkg/util.go":      true,
+		"src/pkg/util_test.go": false,
+		"src/.git":             false,
+		"src/build":            false,
+		"src/notes.log":        false,
+		"src/keep.log":         true,
+		"src/vendor/.git":      false,
+		"src/vendor/lib":       true,
+		"gosrc/main.go":        true,
+		"gosrc/util.go":        true,
+		"gosrc/util_test.go":   true,
+		"gosrc/lib.go":         true,
+		"app/main.go":          true,
+	}
+	for p, exists := range wanted {
+		_, err := os.Lstat(path.Join(rootfs, p))
+		switch {
+		case exists && err != nil:
+			t.Errorf("%s wasn't copied: %v", p, err)
+		case !exists && err == nil:
+			t.Errorf("%s was copied", p)
+		}
+	}
+
+	exitCode, _, stderr, _ := runACBuild(workingDir, "--no-history", "copy", "src/**/*.go", "/x")
+	if exitCode == 0 || !strings.Contains(stderr, "matches 4 files") {
+		t.Errorf("copying several files with copy: exit code %d, %s", exitCode, stderr)
+	}
+	exitCode, _, stderr, _ = runACBuild(workingDir, "--no-history", "copy-to-dir", "src/*.txt", "/x")
+	if exitCode == 0 || !strings.Contains(stderr, `no files match "src/*.txt"`) {
+		t.Errorf("copying a glob without matches: exit code %d, %s", exitCode, stderr)
+	}
+}
@@ -15,11 +15,21 @@
 package tests
 
 import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
@@ -287,3 +297,199 @@ func TestRmNonexistentDependency(t *testing.T) {
 	checkManifest(t, workingDir, emptyManifest())
 	checkEmptyRootfs(t, workingDir)
 }
+
+func writeLockFile(t *testing.T, dir, name string) string {
+	lockPath := path.Join(dir, "acbuild.lock")
+	lock := fmt.Sprintf(`{"dependencies":[{"imageName":%q,"imageID":%q,"images":[{"imageName":%q,"imageID":%q}]}]}`,
+		name, depImageID, name, depImageID)
+	err := ioutil.WriteFile(lockPath, []byte(lock), 0644)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	return lockPath
+}
+
+func TestLockNoDependencies(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	lockPath := path.Join(workingDir, "acbuild.lock")
+	err := runACBuildNoHist(workingDir, "dependency", "lock", "--save", lockPath)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	blob, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var lock struct {
+		Dependencies []interface{} `json:"dependencies"`
+	}
+	err = json.Unmarshal(blob, &lock)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if lock.Dependencies == nil || len(lock.Dependencies) != 0 {
+		t.Errorf("expected an empty list of locked dependencies, got: %s", blob)
+	}
+
+	checkManifest(t, workingDir, emptyManifest())
+}
+
+func TestLockFromFile(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "dependency", "add", depName)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	lockPath := writeLockFile(t, workingDir, depName)
+	err = runACBuildNoHist(workingDir, "dependency", "lock", "--from", lockPath)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, err = os.Stat(path.Join(workingDir, ".acbuild", "dependencies.lock"))
+	if err != nil {
+		t.Fatalf("lock wasn't stored in the build context: %v", err)
+	}
+}
+
+func TestLockFromMismatchedFile(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "dependency", "add", depName)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	lockPath := writeLockFile(t, workingDir, depName2)
+	err = runACBuildNoHist(workingDir, "dependency", "lock", "--from", lockPath)
+	if err == nil {
+		t.Fatalf("dependency lock accepted a lock for different dependencies")
+	}
+}
+
+// ociManifest reads the manifest of the OCI image layout at layoutPath.
+func ociManifest(t *testing.T, layoutPath string) ociImage.Manifest {
+	var ref ociImage.Descriptor
+	var manifest ociImage.Manifest
+	refBlob, err := ioutil.ReadFile(path.Join(layoutPath, "refs", "latest"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := json.Unmarshal(refBlob, &ref); err != nil {
+		t.Fatalf("%v", err)
+	}
+	manBlob, err := ioutil.ReadFile(path.Join(layoutPath, "blobs", strings.Replace(ref.Digest, ":", "/", 1)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := json.Unmarshal(manBlob, &manifest); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return manifest
+}
+
+// writeOCIBaseImage builds an OCI image with a single layer and writes it to a
+// tar in dir.
+func writeOCIBaseImage(t *testing.T, dir string) string {
+	rootfsTar := path.Join(dir, "rootfs.tar")
+	f, err := os.Create(rootfsTar)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tw := tar.NewWriter(f)
+	contents := []byte("base")
+	tw.WriteHeader(&tar.Header{Name: "base-file", Mode: 0644, Size: int64(len(contents))})
+	tw.Write(contents)
+	tw.Close()
+	f.Close()
+
+	baseDir := path.Join(dir, "base")
+	if err := os.Mkdir(baseDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, _, _, err := runACBuild(baseDir, "begin", "--build-mode", "oci", rootfsTar); err != nil {
+		t.Fatalf("%v", err)
+	}
+	baseTar := path.Join(dir, "base.tar")
+	if err := runACBuildNoHist(baseDir, "write", baseTar); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := runACBuildNoHist(baseDir, "end"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return baseTar
+}
+
+func TestAddOCIBaseImage(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer cleanUpTest(tmpdir)
+	baseTar := writeOCIBaseImage(t, tmpdir)
+
+	workingDir := path.Join(tmpdir, "app")
+	if err := os.Mkdir(workingDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, _, _, err := runACBuild(workingDir, "begin", "--build-mode", "oci"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := runACBuildNoHist(workingDir, "dependency", "add", "../base.tar"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	man := ociManifest(t, path.Join(workingDir, ".acbuild", "currentaci"))
+	if want := fmt.Sprintf("[%q]", baseTar); man.Annotations["org.containers.build.base-images"] != want {
+		t.Errorf("unexpected base images annotation: %q, wanted %q", man.Annotations["org.containers.build.base-images"], want)
+	}
+
+	// The written image should have the base image's layer flattened into it,
+	// and no longer refer to the base image.
+	appTar := path.Join(tmpdir, "app.tar")
+	if err := runACBuildNoHist(workingDir, "write", appTar); err != nil {
+		t.Fatalf("%v", err)
+	}
+	outDir := path.Join(tmpdir, "out")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := exec.Command("tar", "-C", outDir, "-xf", appTar).Run(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	man = ociManifest(t, outDir)
+	if len(man.Layers) != 1 {
+		t.Fatalf("expected 1 layer in the written image, got %d", len(man.Layers))
+	}
+	if _, err := os.Stat(path.Join(outDir, "blobs", strings.Replace(man.Layers[0].Digest, ":", "/", 1))); err != nil {
+		t.Errorf("base layer missing from written image: %v", err)
+	}
+	if _, ok := man.Annotations["org.containers.build.base-images"]; ok {
+		t.Errorf("written image still has base images annotation")
+	}
+
+	if err := runACBuildNoHist(workingDir, "dependency", "remove", "../base.tar"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	man = ociManifest(t, path.Join(workingDir, ".acbuild", "currentaci"))
+	if _, ok := man.Annotations["org.containers.build.base-images"]; ok {
+		t.Errorf("base images annotation wasn't removed")
+	}
+}
+
+func TestAddOCIBaseImageWithLabel(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	if _, _, _, err := runACBuild(workingDir, "begin", "--build-mode", "oci"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	err := runACBuildNoHist(workingDir, "dependency", "add", "docker://busybox", "--label", "version=1")
+	if err == nil {
+		t.Errorf("dependency add with a label succeeded in an OCI build")
+	}
+}
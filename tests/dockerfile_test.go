@@ -0,0 +1,111 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/schema/types"
+)
+
+func TestDockerfileBuild(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "hello.txt", "hello\n")
+	writeScript(t, workingDir, "Dockerfile", `FROM scratch
+ARG VERSION=1.0
+ENV APP_HOME=/opt/app \
+    GREETING="hello world"
+LABEL version=$VERSION
+WORKDIR $APP_HOME
+COPY hello.txt ./
+USER 1000:100
+EXPOSE 8080 53/udp
+VOLUME /data
+ENTRYPOINT ["/bin/app"]
+CMD ["--port", "8080"]
+`)
+
+	_, _, _, err := runACBuild(workingDir, "dockerfile", "build", "--build-mode", "appc",
+		"--name", "example.com/app", "--arg", "VERSION=2.0", "Dockerfile", "out.aci")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	man := readACIManifest(t, path.Join(workingDir, "out.aci"))
+	if man.Name != "example.com/app" {
+		t.Errorf("name is %s, wanted example.com/app", man.Name)
+	}
+	if version, _ := man.Annotations.Get("version"); version != "2.0" {
+		t.Errorf("version annotation is %q, wanted 2.0", version)
+	}
+
+	app := man.App
+	wantedEnv := types.Environment{
+		{Name: "APP_HOME", Value: "/opt/app"},
+		{Name: "GREETING", Value: "hello world"},
+	}
+	if !reflect.DeepEqual(app.Environment, wantedEnv) {
+		t.Errorf("environment is %v, wanted %v", app.Environment, wantedEnv)
+	}
+	if app.WorkingDirectory != "/opt/app" {
+		t.Errorf("working directory is %s, wanted /opt/app", app.WorkingDirectory)
+	}
+	if app.User != "1000" || app.Group != "100" {
+		t.Errorf("user and group are %s:%s, wanted 1000:100", app.User, app.Group)
+	}
+	wantedExec := types.Exec{"/bin/app", "--port", "8080"}
+	if !reflect.DeepEqual(app.Exec, wantedExec) {
+		t.Errorf("exec is %v, wanted %v", app.Exec, wantedExec)
+	}
+	if len(app.Ports) != 2 || app.Ports[0].Port != 8080 || app.Ports[1].Protocol != "udp" {
+		t.Errorf("unexpected ports: %v", app.Ports)
+	}
+	if len(app.MountPoints) != 1 || app.MountPoints[0].Path != "/data" {
+		t.Errorf("unexpected mount points: %v", app.MountPoints)
+	}
+}
+
+func TestDockerfileUnsupported(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "Dockerfile", `FROM scratch
+HEALTHCHECK CMD /bin/check
+ONBUILD RUN make
+LABEL ok=yes
+`)
+
+	_, _, stderr, err := runACBuild(workingDir, "dockerfile", "build", "Dockerfile", "out.oci")
+	if err == nil {
+		t.Fatalf("build succeeded")
+	}
+	for _, problem := range []string{
+		"Dockerfile:2: HEALTHCHECK is not supported",
+		"Dockerfile:3: ONBUILD is not supported",
+	} {
+		if !strings.Contains(stderr, problem) {
+			t.Errorf("%q wasn't reported, got:\n%s", problem, stderr)
+		}
+	}
+	if _, err := os.Stat(path.Join(workingDir, "out.oci")); !os.IsNotExist(err) {
+		t.Errorf("image was written despite unsupported instructions")
+	}
+}
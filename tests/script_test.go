@@ -0,0 +1,385 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+)
+
+func writeScript(t *testing.T, dir, name, script string) {
+	err := ioutil.WriteFile(path.Join(dir, name), []byte(script), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func readACIManifest(t *testing.T, aciPath string) *schema.ImageManifest {
+	f, err := os.Open(aciPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	man, err := aci.ManifestFromImage(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return man
+}
+
+func TestScript(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "nested.acb", "annotation add nested yes\n")
+	writeScript(t, workingDir, "build.acb", `begin
+set-name example.com/app
+dependency add example.com/dep1 --label version=1
+dependency add example.com/dep2
+script nested.acb
+write out.aci
+`)
+
+	_, _, _, err := runACBuild(workingDir, "script", "build.acb")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	man := readACIManifest(t, path.Join(workingDir, "out.aci"))
+
+	// Flags given on one line mustn't carry over to the next.
+	if len(man.Dependencies) != 2 {
+		t.Fatalf("expected 2 dependencies, got %d", len(man.Dependencies))
+	}
+	if len(man.Dependencies[1].Labels) != 0 {
+		t.Errorf("labels of the first dependency were added to the second: %v", man.Dependencies[1].Labels)
+	}
+
+	wanted := map[string]string{
+		"coreos.com/acbuild/command-1": `acbuild set-name "example.com/app"`,
+		"coreos.com/acbuild/command-2": `acbuild dependency add "example.com/dep1"`,
+		"coreos.com/acbuild/command-3": `acbuild dependency add "example.com/dep2"`,
+		"coreos.com/acbuild/command-4": `acbuild annotation add "nested" "yes"`,
+		"nested":                       "yes",
+	}
+	for name, value := range wanted {
+		got, ok := man.Annotations.Get(name)
+		if !ok || got != value {
+			t.Errorf("annotation %s is %q, wanted %q", name, got, value)
+		}
+	}
+	if len(man.Annotations) != len(wanted) {
+		t.Errorf("unexpected annotations: %v", man.Annotations)
+	}
+
+	if _, err := os.Stat(path.Join(workingDir, ".acbuild")); !os.IsNotExist(err) {
+		t.Errorf("script left a build context behind")
+	}
+}
+
+func TestScriptErrorCode(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "build.acb", `begin
+label remove nonexistent
+write out.aci
+`)
+
+	exitCode, _, _, err := runACBuild(workingDir, "script", "build.acb")
+	if err == nil {
+		t.Fatalf("script succeeded")
+	}
+	if exitCode != 2 {
+		t.Errorf("unexpected exit code %d, wanted 2", exitCode)
+	}
+	if _, err := os.Stat(path.Join(workingDir, "out.aci")); !os.IsNotExist(err) {
+		t.Errorf("script kept going after a failed line")
+	}
+}
+
+func TestScriptUnknownCommand(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "build.acb", "begin\nnot-a-command\n")
+
+	exitCode, _, _, err := runACBuild(workingDir, "script", "build.acb")
+	if err == nil {
+		t.Fatalf("script succeeded")
+	}
+	if exitCode != 3 {
+		t.Errorf("unexpected exit code %d, wanted 3", exitCode)
+	}
+}
+
+func TestScriptBuildArgs(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "build.acb", `ARG VERSION
+ARG CHANNEL=stable
+SET NAME=example.com/app-${CHANNEL}
+begin
+set-name ${NAME}
+label add version ${VERSION:-dev}
+write out-${VERSION}.aci
+`)
+
+	for _, version := range []string{"1.2", "1.3"} {
+		_, _, _, err := runACBuild(workingDir, "script", "--arg", "VERSION="+version, "build.acb")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		man := readACIManifest(t, path.Join(workingDir, "out-"+version+".aci"))
+		if man.Name != "example.com/app-stable" {
+			t.Errorf("unexpected name %s", man.Name)
+		}
+		if v, _ := man.Labels.Get("version"); v != version {
+			t.Errorf("unexpected version label %q, wanted %q", v, version)
+		}
+	}
+
+	// Without a value for VERSION, the write line refers to an undefined
+	// variable.
+	_, _, stderr, err := runACBuild(workingDir, "script", "build.acb")
+	if err == nil {
+		t.Fatalf("script with an undefined variable succeeded")
+	}
+	if !strings.Contains(stderr, `undefined variable "VERSION"`) {
+		t.Errorf("unexpected error: %s", stderr)
+	}
+}
+
+func TestScriptStages(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "app", "binary\n")
+	writeScript(t, workingDir, "build.acb", `STAGE builder
+begin
+copy app /build/out/app
+STAGE runtime
+begin
+set-name example.com/app
+copy --from builder /build/out/app /usr/bin/app
+write out.aci
+`)
+
+	_, _, _, err := runACBuild(workingDir, "script", "build.acb")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	f, err := os.Open(path.Join(workingDir, "out.aci"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	tr, err := aci.NewCompressedTarReader(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer tr.Close()
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name == "rootfs/usr/bin/app" {
+			found = true
+		}
+		if strings.HasPrefix(hdr.Name, "rootfs/build") {
+			t.Errorf("file from the builder stage leaked into the image: %s", hdr.Name)
+		}
+	}
+	if !found {
+		t.Errorf("copied file missing from the image")
+	}
+}
+
+func TestScriptErrorLocation(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "nested.acb", "annotation add nested yes\n\nlabel remove \\\n    nonexistent\n")
+	writeScript(t, workingDir, "build.acb", `begin
+# Comments and blank lines count too
+
+script nested.acb
+write out.aci
+`)
+
+	exitCode, _, stderr, err := runACBuild(workingDir, "script", "--trace", "build.acb")
+	if err == nil {
+		t.Fatalf("script succeeded")
+	}
+	if exitCode != 2 {
+		t.Errorf("unexpected exit code %d, wanted 2", exitCode)
+	}
+	for _, wanted := range []string{
+		"+ build.acb:4: script nested.acb\n",
+		"+ nested.acb:3: label remove nonexistent\n",
+		"script: build.acb:4: script: nested.acb:3: label: exit status 2\n",
+		"\tlabel remove  nonexistent\n",
+	} {
+		if !strings.Contains(stderr, wanted) {
+			t.Errorf("%q missing from output:\n%s", wanted, stderr)
+		}
+	}
+}
+
+func TestScriptCheck(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "good.acb", "begin\nset-name example.com/app\nwrite out.aci\n")
+	writeScript(t, workingDir, "bad.acb", "begin\nnot-a-command\nend\n")
+
+	_, _, _, err := runACBuild(workingDir, "script", "--check", "good.acb")
+	if err != nil {
+		t.Errorf("checking a valid script failed: %v", err)
+	}
+
+	_, _, stderr, err := runACBuild(workingDir, "script", "--check", "bad.acb")
+	if err == nil {
+		t.Errorf("checking an invalid script succeeded")
+	}
+	for _, wanted := range []string{
+		`bad.acb:2: unknown command "not-a-command"`,
+		"bad.acb:3: end: calling end is unnecessary",
+		"bad.acb: the script never calls write",
+	} {
+		if !strings.Contains(stderr, wanted) {
+			t.Errorf("%q missing from output:\n%s", wanted, stderr)
+		}
+	}
+
+	for _, name := range []string{".acbuild", "out.aci"} {
+		if _, err := os.Stat(path.Join(workingDir, name)); !os.IsNotExist(err) {
+			t.Errorf("checking a script created %s", name)
+		}
+	}
+}
+
+func TestScriptResume(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	failing := `ARG VERSION=1.0
+begin
+set-name example.com/app
+annotation add first yes
+label remove nonexistent
+annotation add version ${VERSION}
+write out.aci
+`
+	writeScript(t, workingDir, "build.acb", failing)
+	_, _, stderr, err := runACBuild(workingDir, "script", "--keep-on-failure", "build.acb")
+	if err == nil {
+		t.Fatalf("script succeeded")
+	}
+	if !strings.Contains(stderr, "--resume") {
+		t.Errorf("no hint about --resume in output:\n%s", stderr)
+	}
+	keepPath := path.Join(workingDir, ".acbuild-script")
+	if _, err := os.Stat(path.Join(keepPath, "state.json")); err != nil {
+		t.Fatalf("the failed build wasn't kept: %v", err)
+	}
+
+	writeScript(t, workingDir, "build.acb", strings.Replace(failing, "first yes", "first no", 1))
+	_, _, _, err = runACBuild(workingDir, "script", "--resume", "build.acb")
+	if err == nil {
+		t.Fatalf("resumed a script whose completed steps changed")
+	}
+
+	writeScript(t, workingDir, "build.acb", strings.Replace(failing, "label remove nonexistent", "label add arch amd64", 1))
+	_, _, _, err = runACBuild(workingDir, "script", "--resume", "build.acb")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	man := readACIManifest(t, path.Join(workingDir, "out.aci"))
+	for name, wanted := range map[string]string{"first": "yes", "version": "1.0"} {
+		if val, _ := man.Annotations.Get(name); val != wanted {
+			t.Errorf("annotation %s is %q, wanted %q", name, val, wanted)
+		}
+	}
+	if arch, _ := man.Labels.Get("arch"); arch != "amd64" {
+		t.Errorf("arch label is %q, wanted amd64", arch)
+	}
+	if _, err := os.Stat(keepPath); !os.IsNotExist(err) {
+		t.Errorf("the kept build wasn't removed after the script succeeded")
+	}
+}
+
+func TestScriptInclude(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	err := os.Mkdir(path.Join(workingDir, "fragments"), 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	writeScript(t, workingDir, "fragments/service.acb", `ARG USER
+ARG PORT=80
+annotation add service-user ${USER}
+include common.acb PORT=${PORT}
+`)
+	writeScript(t, workingDir, "fragments/common.acb", "ARG PORT\nport add http tcp ${PORT}\n")
+	writeScript(t, workingDir, "build.acb", `begin
+set-name example.com/app
+include fragments/service.acb USER=app PORT=8080
+write out.aci
+`)
+
+	_, _, _, err = runACBuild(workingDir, "script", "build.acb")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	man := readACIManifest(t, path.Join(workingDir, "out.aci"))
+	if user, _ := man.Annotations.Get("service-user"); user != "app" {
+		t.Errorf("service-user annotation is %q, wanted app", user)
+	}
+	if len(man.App.Ports) != 1 || man.App.Ports[0].Port != 8080 {
+		t.Errorf("unexpected ports: %v", man.App.Ports)
+	}
+
+	writeScript(t, workingDir, "fragments/common.acb", "include service.acb USER=loop\n")
+	_, _, stderr, err := runACBuild(workingDir, "script", "build.acb")
+	if err == nil {
+		t.Fatalf("script with an include cycle succeeded")
+	}
+	wanted := "cycle: fragments/service.acb -> fragments/common.acb -> fragments/service.acb"
+	if !strings.Contains(stderr, wanted) {
+		t.Errorf("%q missing from output:\n%s", wanted, stderr)
+	}
+
+	_, _, stderr, err = runACBuild(workingDir, "script", "--check", "build.acb")
+	if err == nil {
+		t.Fatalf("check of a script with an include cycle succeeded")
+	}
+	wanted = "fragments/common.acb:1: include: fragments/service.acb is already being included"
+	if !strings.Contains(stderr, wanted) {
+		t.Errorf("%q missing from output:\n%s", wanted, stderr)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/appc/spec/aci"
+)
+
+// readACIFile returns the header and contents of the file at p in the rootfs
+// of an ACI.
+func readACIFile(t *testing.T, aciPath, p string) (*tar.Header, string) {
+	f, err := os.Open(aciPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	r, err := aci.NewCompressedReader(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			t.Fatalf("%s not found in %s", p, aciPath)
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if path.Clean(hdr.Name) == path.Join(aci.RootfsDir, p) {
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			return hdr, string(contents)
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "write-file", "--content", "hello\n", "--mode", "0600", "/etc/app/hello.conf")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	target := path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir, "etc", "app", "hello.conf")
+	contents, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(contents) != "hello\n" {
+		t.Errorf("contents are %q, wanted %q", contents, "hello\n")
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode is %o, wanted 600", info.Mode().Perm())
+	}
+
+	err = runACBuildNoHist(workingDir, "write-file", "--mode", "999", "/etc/app/hello.conf")
+	if err == nil {
+		t.Errorf("invalid mode was accepted")
+	}
+}
+
+func TestWriteFileHeredoc(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	writeScript(t, workingDir, "build.acb", `ARG PORT=80
+begin
+set-name example.com/app
+write-file --mode 0640 /etc/app.conf <<EOF
+  listen ${PORT}
+EOF
+write-file /etc/motd <<'END'
+	${PORT} is not expanded
+END
+write out.aci
+`)
+
+	_, _, _, err := runACBuild(workingDir, "script", "--arg", "PORT=8080", "build.acb")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	aciPath := path.Join(workingDir, "out.aci")
+	hdr, contents := readACIFile(t, aciPath, "etc/app.conf")
+	if contents != "  listen 8080\n" {
+		t.Errorf("app.conf is %q", contents)
+	}
+	if hdr.Mode&0777 != 0640 {
+		t.Errorf("app.conf mode is %o, wanted 640", hdr.Mode&0777)
+	}
+	_, contents = readACIFile(t, aciPath, "etc/motd")
+	if contents != "\t${PORT} is not expanded\n" {
+		t.Errorf("motd is %q", contents)
+	}
+}
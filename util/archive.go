@@ -0,0 +1,185 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/aci"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+// ExtractArchive unpacks the tar archive, which may be compressed with gzip,
+// bzip2 or xz, or the zip archive at p into the directory dst.
+func ExtractArchive(p, dst string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(zipMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == nil && bytes.Equal(magic, zipMagic) {
+		return extractZip(p, dst)
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	ftype, err := aci.DetectFileType(f)
+	if err != nil {
+		return err
+	}
+	switch ftype {
+	case aci.TypeTar, aci.TypeGzip, aci.TypeBzip2, aci.TypeXz:
+		return ExtractImage(p, dst, nil)
+	}
+	return fmt.Errorf("not a tar or zip archive")
+}
+
+// extractZip unpacks the zip archive at p into dst.
+func extractZip(p, dst string) error {
+	r, err := zip.OpenReader(p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var dirs []*zip.File
+	for _, f := range r.File {
+		name := path.Clean("/" + f.Name)[1:]
+		if name == "" {
+			continue
+		}
+		if err := checkNoSymlinks(dst, path.Dir(name)); err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+		target := filepath.Join(dst, name)
+
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(target, 0755)
+			dirs = append(dirs, f)
+		case mode&os.ModeSymlink != 0:
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = extractZipSymlink(f, target)
+			}
+		case mode.IsRegular():
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = extractZipFile(f, target)
+			}
+		default:
+			err = fmt.Errorf("unsupported mode: %v", mode)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+
+	// Directories are given their modes and times last, so that creating
+	// files in them can't fail or change their times.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		f := dirs[i]
+		target := filepath.Join(dst, path.Clean("/" + f.Name)[1:])
+		if err := os.Chmod(target, f.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, f.ModTime(), f.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipFile(f *zip.File, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, f.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, rc); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, f.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, f.ModTime(), f.ModTime())
+}
+
+func extractZipSymlink(f *zip.File, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	link, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	return os.Symlink(string(link), target)
+}
+
+// checkNoSymlinks returns an error if any directory in the slash separated
+// path dir, relative to root, is a symlink, which a malicious archive could
+// use to write files outside of root.
+func checkNoSymlinks(root, dir string) error {
+	if dir == "." {
+		return nil
+	}
+	p := root
+	for _, elem := range strings.Split(dir, "/") {
+		p = filepath.Join(p, elem)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeZip(t *testing.T, p string, write func(zw *zip.Writer)) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	write(zw)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestExtractZipStaysInside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-zip")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "dst")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{dst, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Names escaping the directory are kept inside it.
+	archive := filepath.Join(dir, "dotdot.zip")
+	writeZip(t, archive, func(zw *zip.Writer) {
+		w, err := zw.Create("../../escaped")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		w.Write([]byte("x"))
+	})
+	if err := ExtractArchive(archive, dst); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "escaped")); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// Files can't be written through a symlink in the archive.
+	archive = filepath.Join(dir, "symlink.zip")
+	writeZip(t, archive, func(zw *zip.Writer) {
+		hdr := &zip.FileHeader{Name: "link"}
+		hdr.SetMode(os.ModeSymlink | 0777)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		w.Write([]byte(outside))
+		w, err = zw.Create("link/file")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		w.Write([]byte("x"))
+	})
+	if err := ExtractArchive(archive, dst); err == nil {
+		t.Errorf("no error writing through a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); err == nil {
+		t.Errorf("a file was written outside of the destination")
+	}
+}
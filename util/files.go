@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 
 	"github.com/appc/spec/aci"
+	"github.com/appc/spec/pkg/tarheader"
 	rkttar "github.com/rkt/rkt/pkg/tar"
 	"github.com/rkt/rkt/pkg/user"
 )
@@ -64,20 +65,37 @@ func ExtractImage(path, dst string, fileMap map[string]struct{}) error {
 	defer dr.Close()
 
 	uidRange := user.NewBlankUidRange()
-
-	if os.Geteuid() == 0 {
-		return rkttar.ExtractTar(dr, dst, true, uidRange, fileMap)
+	var editor rkttar.FilePermissionsEditor
+	if os.Geteuid() != 0 {
+		editor, err = rkttar.NewUidShiftingFilePermEditor(uidRange)
+		if err != nil {
+			return fmt.Errorf("error determining current user: %v", err)
+		}
 	}
 
-	editor, err := rkttar.NewUidShiftingFilePermEditor(uidRange)
-	if err != nil {
-		return fmt.Errorf("error determining current user: %v", err)
+	rec, r := newXattrRecorder(dr)
+	if editor == nil {
+		err = rkttar.ExtractTar(r, dst, true, uidRange, fileMap)
+	} else {
+		err = rkttar.ExtractTarInsecure(tar.NewReader(r), dst, true, fileMap, editor)
+	}
+	if err1 := rec.restore(dst, fileMap); err == nil {
+		err = err1
 	}
-	return rkttar.ExtractTarInsecure(tar.NewReader(dr), dst, true, fileMap, editor)
+	return err
 }
 
 func PathWalker(twriter *tar.Writer, tarSrcPath string) func(string, os.FileInfo, error) error {
+	return EditingPathWalker(twriter, tarSrcPath, nil)
+}
+
+// EditingPathWalker is like PathWalker, but calls edit, if it isn't nil, with
+// the header of every file before it's written.
+func EditingPathWalker(twriter *tar.Writer, tarSrcPath string, edit func(*tar.Header)) func(string, os.FileInfo, error) error {
 	prefixLen := len(tarSrcPath + "/")
+	// Files seen so far by inode, so that later hard links to them are
+	// written as links instead of copies.
+	inodes := make(map[uint64]string)
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -85,48 +103,57 @@ func PathWalker(twriter *tar.Writer, tarSrcPath string) func(string, os.FileInfo
 		if path == tarSrcPath {
 			return nil
 		}
-		hdrName := path[prefixLen:]
-
-		switch {
-		case info.Mode()&os.ModeSymlink != 0:
-			target, err := os.Readlink(path)
-			if err != nil {
-				return err
-			}
-			hdr, err := tar.FileInfoHeader(info, target)
-			hdr.Name = hdrName
-			twriter.WriteHeader(hdr)
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
 
-		case info.Mode().IsRegular():
-			hdr, err := tar.FileInfoHeader(info, "")
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
 			if err != nil {
 				return err
 			}
-			hdr.Name = hdrName
-			twriter.WriteHeader(hdr)
-
-			f, err := os.Open(path)
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path[prefixLen:]
+		// Sets the owner and device numbers, and turns hard links to a
+		// file already written into TypeLink entries.
+		tarheader.Populate(hdr, info, inodes)
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Size = 0
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			hdr.Xattrs, err = ReadXattrs(path)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
+		}
+		if edit != nil {
+			edit(hdr)
+		}
+		if err := twriter.WriteHeader(hdr); err != nil {
+			return err
+		}
 
-			n, err := io.Copy(twriter, f)
-			if err != nil {
-				return err
-			}
-			if n != info.Size() {
-				return fmt.Errorf("underwrite error")
-			}
-		default:
-			hdr, err := tar.FileInfoHeader(info, "")
-			if err != nil {
-				return err
-			}
-			hdr.Name = hdrName
-			twriter.WriteHeader(hdr)
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
 
+		n, err := io.Copy(twriter, f)
+		if err != nil {
+			return err
+		}
+		if n != info.Size() {
+			return fmt.Errorf("underwrite error")
+		}
 		return nil
 	}
 }
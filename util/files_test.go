@@ -0,0 +1,132 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/appc/spec/pkg/device"
+	"github.com/rkt/rkt/pkg/fileutil"
+)
+
+func TestPathWalkerRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-walker")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, d := range []string{filepath.Join(src, "bin"), dst} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	ping := filepath.Join(src, "bin", "ping")
+	if err := ioutil.WriteFile(ping, []byte("ping"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Link(ping, filepath.Join(src, "bin", "ping6")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = fileutil.Lsetxattr(ping, "user.acbuild", []byte("test"), 0)
+	if err == syscall.ENOTSUP {
+		t.Skip("extended attributes aren't supported on this filesystem")
+	}
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	withDevice := os.Geteuid() == 0
+	if withDevice {
+		mode := uint32(syscall.S_IFCHR | 0666)
+		if err := syscall.Mknod(filepath.Join(src, "null"), mode, int(device.Makedev(1, 3))); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	tarPath := filepath.Join(dir, "layer.tar")
+	f, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tw := tar.NewWriter(f)
+	if err := filepath.Walk(src, PathWalker(tw, src)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.Close()
+
+	headers := make(map[string]*tar.Header)
+	f, err = os.Open(tarPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		headers[hdr.Name] = hdr
+	}
+	f.Close()
+
+	if hdr := headers["bin/ping6"]; hdr == nil || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "bin/ping" {
+		t.Errorf("bin/ping6 isn't a hard link to bin/ping: %+v", hdr)
+	}
+	if hdr := headers["bin/ping"]; hdr == nil || hdr.Xattrs["user.acbuild"] != "test" {
+		t.Errorf("bin/ping doesn't have its xattrs: %+v", hdr)
+	}
+	if hdr := headers["null"]; withDevice && (hdr == nil || hdr.Typeflag != tar.TypeChar || hdr.Devmajor != 1 || hdr.Devminor != 3) {
+		t.Errorf("null isn't a character device 1:3: %+v", hdr)
+	}
+
+	if err := ExtractImage(tarPath, dst, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	pingInfo, err := os.Stat(filepath.Join(dst, "bin", "ping"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ping6Info, err := os.Stat(filepath.Join(dst, "bin", "ping6"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !os.SameFile(pingInfo, ping6Info) {
+		t.Errorf("the hard link wasn't restored")
+	}
+	val, err := fileutil.Lgetxattr(filepath.Join(dst, "bin", "ping"), "user.acbuild")
+	if err != nil || string(val) != "test" {
+		t.Errorf("the xattr wasn't restored: %q, %v", val, err)
+	}
+	if withDevice {
+		info, err := os.Lstat(filepath.Join(dst, "null"))
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			t.Errorf("the device wasn't restored: %v", err)
+		}
+	}
+}
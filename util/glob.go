@@ -0,0 +1,144 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// HasGlobMeta returns whether pattern contains any of the characters that are
+// special in glob patterns.
+func HasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
+// compileGlob converts a glob pattern, matching slash separated paths, to a
+// regular expression. As well as the syntax of filepath.Match, a path element
+// of ** matches zero or more directories.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var re bytes.Buffer
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			atStart := i == 0 || pattern[i-1] == '/'
+			if i+1 < len(pattern) && pattern[i+1] == '*' && atStart {
+				switch {
+				case i+2 == len(pattern):
+					re.WriteString(".*")
+					i++
+					continue
+				case pattern[i+2] == '/':
+					re.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+			}
+			re.WriteString("[^/]*")
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == 0 && i+2 < len(pattern) {
+				// A ] right after the [ is part of the class.
+				end = strings.IndexByte(pattern[i+2:], ']')
+				if end != -1 {
+					end++
+				}
+			}
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated character class in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") || strings.HasPrefix(class, "^") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 == len(pattern) {
+				return nil, fmt.Errorf("trailing backslash in %q", pattern)
+			}
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// Glob returns the paths matching pattern, in lexical order. It accepts the
+// same patterns as filepath.Glob, and a path element of ** matches zero or
+// more directories.
+func Glob(pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+
+	// Walk from the longest leading directory without any special
+	// characters.
+	elems := strings.Split(pattern, "/")
+	var static []string
+	for _, elem := range elems[:len(elems)-1] {
+		if HasGlobMeta(elem) {
+			break
+		}
+		static = append(static, elem)
+	}
+	root, rest := ".", pattern
+	if len(static) != 0 {
+		root = strings.Join(static, "/")
+		rest = strings.TrimPrefix(pattern[len(root):], "/")
+		if root == "" {
+			root = "/"
+		}
+	}
+
+	re, err := compileGlob(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if re.MatchString(filepath.ToSlash(rel)) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
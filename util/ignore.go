@@ -0,0 +1,140 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Ignore is a list of patterns, with the syntax of a .gitignore file, that
+// picks out paths to leave out.
+type Ignore struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ReadIgnoreFile reads the patterns in the ignore file at p. If there's no
+// such file, the returned Ignore matches nothing.
+func ReadIgnoreFile(p string) (*Ignore, error) {
+	ign := &Ignore{}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return ign, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = ign.read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return ign, nil
+}
+
+func (ign *Ignore) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if strings.HasPrefix(text, "#") {
+			continue
+		}
+		// Trailing spaces are ignored unless they're escaped.
+		for strings.HasSuffix(text, " ") && !strings.HasSuffix(text, "\\ ") {
+			text = text[:len(text)-1]
+		}
+		if text == "" {
+			continue
+		}
+		if err := ign.Add(text); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Add adds a pattern to the end of the list.
+func (ign *Ignore) Add(pattern string) error {
+	p := ignorePattern{}
+	if strings.HasPrefix(pattern, "!") {
+		p.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return fmt.Errorf("empty pattern")
+	}
+
+	// A pattern with a slash anywhere but the end is relative to the base
+	// directory, and one without matches a name at any depth.
+	if strings.Contains(pattern, "/") {
+		pattern = strings.TrimPrefix(pattern, "/")
+	} else {
+		pattern = "**/" + pattern
+	}
+	re, err := compileGlob(pattern)
+	if err != nil {
+		return err
+	}
+	p.re = re
+	ign.patterns = append(ign.patterns, p)
+	return nil
+}
+
+// Empty returns whether there are no patterns in the list.
+func (ign *Ignore) Empty() bool {
+	return ign == nil || len(ign.patterns) == 0
+}
+
+// Match returns whether the slash separated path p, relative to the base
+// directory, is ignored. As in a .gitignore file, the last pattern matching p
+// decides, and patterns starting with ! un-ignore paths. Paths under an
+// ignored directory aren't matched on their own, so callers walking a tree
+// should skip ignored directories.
+func (ign *Ignore) Match(p string, isDir bool) bool {
+	if ign == nil {
+		return false
+	}
+	p = path.Clean(p)
+	ignored := false
+	for _, pattern := range ign.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.re.MatchString(p) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	ign := &Ignore{}
+	err := ign.read(strings.NewReader(`# comment
+*.o
+/build
+docs/**/*.html
+tmp/
+!keep.o
+\#notes
+[ab]?.txt
+`))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"main.o", false, true},
+		{"src/lib/util.o", false, true},
+		{"src/keep.o", false, false},
+		{"build", true, true},
+		{"src/build", true, false},
+		{"docs/index.html", false, true},
+		{"docs/api/v1/index.html", false, true},
+		{"src/docs/index.html", false, false},
+		{"tmp", true, true},
+		{"tmp", false, false},
+		{"src/tmp", true, true},
+		{"#notes", false, true},
+		{"# comment", false, false},
+		{"a1.txt", false, true},
+		{"c1.txt", false, false},
+		{"main.go", false, false},
+	}
+	for _, tt := range tests {
+		if ignored := ign.Match(tt.path, tt.isDir); ignored != tt.ignored {
+			t.Errorf("Match(%q, %v) = %v, wanted %v", tt.path, tt.isDir, ignored, tt.ignored)
+		}
+	}
+
+	if err := ign.Add("[abc"); err == nil {
+		t.Errorf("no error for an unterminated character class")
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-glob")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.go", "b.txt", "pkg/c.go", "pkg/sub/d.go", "pkg/sub/e.txt"} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		matches []string
+	}{
+		{"*.go", []string{"a.go"}},
+		{"**/*.go", []string{"a.go", "pkg/c.go", "pkg/sub/d.go"}},
+		{"pkg/**/*.txt", []string{"pkg/sub/e.txt"}},
+		{"pkg/*", []string{"pkg/c.go", "pkg/sub"}},
+		{"pkg/**", []string{"pkg/c.go", "pkg/sub", "pkg/sub/d.go", "pkg/sub/e.txt"}},
+		{"?.[gt]*", []string{"a.go", "b.txt"}},
+		{"missing/*", nil},
+	}
+	for _, tt := range tests {
+		matches, err := Glob(filepath.Join(dir, tt.pattern))
+		if err != nil {
+			t.Errorf("%s: %v", tt.pattern, err)
+			continue
+		}
+		var rel []string
+		for _, m := range matches {
+			r, err := filepath.Rel(dir, m)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			rel = append(rel, filepath.ToSlash(r))
+		}
+		if !reflect.DeepEqual(rel, tt.matches) {
+			t.Errorf("%s: got %v, wanted %v", tt.pattern, rel, tt.matches)
+		}
+	}
+}
@@ -44,16 +44,17 @@ func OCIExtractLayers(layerIDs []string, imageLoc, blobsDest string) error {
 		_, err = os.Stat(to)
 		if err == nil {
 			// This has already been extracted
-			break
+			continue
 		}
 
-		err = os.MkdirAll(path.Join(blobsDest, algo), 0755)
+		err = os.MkdirAll(to, 0755)
 		if err != nil {
 			return err
 		}
 
 		err = ExtractImage(from, to, nil)
 		if err != nil {
+			os.RemoveAll(to)
 			return err
 		}
 	}
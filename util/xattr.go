@@ -0,0 +1,157 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/rkt/rkt/pkg/fileutil"
+)
+
+// llistxattr returns the names of the extended attributes of the file at p,
+// without following symlinks.
+func llistxattr(p string) ([]string, error) {
+	pathBytes, err := syscall.BytePtrFromString(p)
+	if err != nil {
+		return nil, err
+	}
+	size, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pathBytes)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, _, errno = syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	if errno != 0 {
+		return nil, errno
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// ReadXattrs returns the extended attributes of the file at p, including
+// file capabilities in security.capability, without following symlinks. It
+// returns nil if the filesystem doesn't support them.
+func ReadXattrs(p string) (map[string]string, error) {
+	names, err := llistxattr(p)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: p, Err: err}
+	}
+	var xattrs map[string]string
+	for _, name := range names {
+		val, err := fileutil.Lgetxattr(p, name)
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: p, Err: err}
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = string(val)
+	}
+	return xattrs, nil
+}
+
+// xattrRecorder reads a tar stream as it's being extracted, and records the
+// extended attributes in its headers, which the tar package doesn't restore.
+type xattrRecorder struct {
+	pw     *io.PipeWriter
+	done   chan struct{}
+	xattrs map[string]map[string]string
+	err    error
+}
+
+// newXattrRecorder returns a recorder, and a reader that must be used in
+// place of r to extract the stream.
+func newXattrRecorder(r io.Reader) (*xattrRecorder, io.Reader) {
+	pr, pw := io.Pipe()
+	rec := &xattrRecorder{
+		pw:     pw,
+		done:   make(chan struct{}),
+		xattrs: make(map[string]map[string]string),
+	}
+	go func() {
+		defer close(rec.done)
+		tr := tar.NewReader(pr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rec.err = err
+				break
+			}
+			if len(hdr.Xattrs) != 0 && hdr.Typeflag != tar.TypeLink && hdr.Typeflag != tar.TypeSymlink {
+				rec.xattrs[filepath.Clean(hdr.Name)] = hdr.Xattrs
+			}
+		}
+		// Whatever is left has to be read so that extraction isn't
+		// blocked writing to the pipe.
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return rec, io.TeeReader(r, pw)
+}
+
+// restore sets the recorded extended attributes on the files extracted into
+// dst, once extraction has finished. If fileMap is set, only files in it were
+// extracted. Attributes that the filesystem or an unprivileged user can't set
+// are skipped.
+func (rec *xattrRecorder) restore(dst string, fileMap map[string]struct{}) error {
+	rec.pw.Close()
+	<-rec.done
+	if rec.err != nil {
+		return rec.err
+	}
+	for name, xattrs := range rec.xattrs {
+		if fileMap != nil {
+			if _, ok := fileMap[name]; !ok {
+				continue
+			}
+		}
+		name = path.Clean("/" + name)[1:]
+		if checkNoSymlinks(dst, path.Dir(name)) != nil {
+			continue
+		}
+		p := filepath.Join(dst, name)
+		for attr, val := range xattrs {
+			err := fileutil.Lsetxattr(p, attr, []byte(val), 0)
+			switch {
+			case err == nil:
+			case err == syscall.ENOTSUP, err == syscall.EPERM && os.Geteuid() != 0:
+			default:
+				return &os.PathError{Op: "lsetxattr " + attr, Path: p, Err: err}
+			}
+		}
+	}
+	return nil
+}